@@ -0,0 +1,166 @@
+package frame
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+)
+
+// ErrAccessMismatch is returned when a write targets a row owned by an access id other than the caller's
+var ErrAccessMismatch = errors.New("access id does not match the authentication claims")
+
+// AccessOwnedModel is implemented by models whose rows are private to the access id that created them.
+// Reads and writes of such models are restricted to the AccessID of the authentication claims
+// unless the claims hold one of the roles configured with WithAccessOwnershipRoles.
+// Statements written as raw sql are not restricted, they have to filter on access_id themselves.
+type AccessOwnedModel interface {
+	AccessOwned() bool
+}
+
+// WithAccessOwnershipRoles Option that lists the roles allowed to reach rows of access owned models
+// regardless of the access id that owns them, for example support or administration roles.
+func WithAccessOwnershipRoles(roles ...string) Option {
+	return func(s *Service) {
+		s.dataStore.ownershipRoles = append(s.dataStore.ownershipRoles, roles...)
+	}
+}
+
+// ownershipPlugin gorm plugin restricting access owned models to the access id of the authentication claims
+type ownershipPlugin struct {
+	store *store
+}
+
+func (p *ownershipPlugin) Name() string {
+	return "frame:access_ownership"
+}
+
+func (p *ownershipPlugin) Initialize(db *gorm.DB) error {
+	err := db.Callback().Create().Before("gorm:create").Register("frame:ownership_create", p.enforceCreate)
+	if err != nil {
+		return err
+	}
+
+	err = db.Callback().Query().Before("gorm:query").Register("frame:ownership_query", p.restrict)
+	if err != nil {
+		return err
+	}
+
+	err = db.Callback().Row().Before("gorm:row").Register("frame:ownership_row", p.restrict)
+	if err != nil {
+		return err
+	}
+
+	err = db.Callback().Update().Before("gorm:update").Register("frame:ownership_update", p.enforceUpdate)
+	if err != nil {
+		return err
+	}
+
+	return db.Callback().Delete().Before("gorm:delete").Register("frame:ownership_delete", p.restrict)
+}
+
+// ownedAccess returns the access id rows of the statement are restricted to, if any.
+// Any claims restrict access owned models, even when they do not carry a tenant and partition.
+func (p *ownershipPlugin) ownedAccess(db *gorm.DB) (string, *schema.Field, bool) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return "", nil, false
+	}
+
+	owned, ok := reflect.New(db.Statement.Schema.ModelType).Interface().(AccessOwnedModel)
+	if !ok || !owned.AccessOwned() {
+		return "", nil, false
+	}
+
+	accessField := db.Statement.Schema.LookUpField("access_id")
+	if accessField == nil {
+		return "", nil, false
+	}
+
+	if IsSystem(db.Statement.Context) {
+		return "", nil, false
+	}
+
+	authClaim := ClaimsFromContext(db.Statement.Context)
+	if authClaim == nil {
+		return "", nil, false
+	}
+
+	for _, role := range authClaim.Roles {
+		for _, allowedRole := range p.store.ownershipRoles {
+			if role == allowedRole {
+				return "", nil, false
+			}
+		}
+	}
+
+	return authClaim.AccessID, accessField, true
+}
+
+// restrict limits reads, updates and deletes to rows owned by the caller
+func (p *ownershipPlugin) restrict(db *gorm.DB) {
+	accessID, accessField, ok := p.ownedAccess(db)
+	if !ok {
+		return
+	}
+
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: accessField.DBName}, Value: accessID},
+	}})
+}
+
+// enforceUpdate restricts updates to rows owned by the caller and rejects handing rows over to another access id
+func (p *ownershipPlugin) enforceUpdate(db *gorm.DB) {
+	accessID, accessField, ok := p.ownedAccess(db)
+	if !ok {
+		return
+	}
+
+	if value, ok := updatedValue(db, accessField); ok && value != accessID {
+		_ = db.AddError(ErrAccessMismatch)
+		return
+	}
+
+	err := walkReflectValue(db.Statement.ReflectValue, func(value reflect.Value) error {
+		current, isZero := accessField.ValueOf(db.Statement.Context, value)
+		if !isZero && current != accessID {
+			return ErrAccessMismatch
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+
+	p.restrict(db)
+}
+
+// enforceCreate fills in the access id of new rows and rejects rows owned by someone else.
+// Upserts are restricted so that a conflicting row owned by someone else is never overwritten.
+func (p *ownershipPlugin) enforceCreate(db *gorm.DB) {
+	accessID, accessField, ok := p.ownedAccess(db)
+	if !ok {
+		return
+	}
+
+	err := walkReflectValue(db.Statement.ReflectValue, func(value reflect.Value) error {
+		err := assignOrMatch(db, accessField, value, accessID)
+		if errors.Is(err, ErrTenantMismatch) {
+			return ErrAccessMismatch
+		}
+		return err
+	})
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+
+	if c, ok := db.Statement.Clauses[clause.OnConflict{}.Name()]; ok {
+		if onConflict, ok := c.Expression.(clause.OnConflict); ok && !onConflict.DoNothing {
+			onConflict.Where.Exprs = append(onConflict.Where.Exprs,
+				clause.Eq{Column: clause.Column{Table: db.Statement.Table, Name: accessField.DBName}, Value: accessID})
+			db.Statement.AddClause(onConflict)
+		}
+	}
+}
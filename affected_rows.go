@@ -0,0 +1,222 @@
+package frame
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+	"sync"
+)
+
+const affectedRowsKey = "frame:affected_rows"
+
+// affectedRow is a row written by a statement as reported by its RETURNING clause
+type affectedRow struct {
+	ID       string
+	TenantID string
+	Version  uint
+	// Created is false for the conflicting rows an upsert updated
+	Created bool
+}
+
+// affectedRows collects the rows written by the statements of a session set up by captureAffectedRows
+type affectedRows struct {
+	mutex sync.Mutex
+	rows  []affectedRow
+}
+
+func (ar *affectedRows) add(rows ...affectedRow) {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+	ar.rows = append(ar.rows, rows...)
+}
+
+func (ar *affectedRows) list() []affectedRow {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+	return append([]affectedRow(nil), ar.rows...)
+}
+
+// captureAffectedRows returns a session recording the rows its creates, updates and deletes write.
+// Unlike the instances handed to a statement the rows carry the ids upserts resolved conflicts to.
+func captureAffectedRows(db *gorm.DB) (*gorm.DB, *affectedRows) {
+	rows := &affectedRows{}
+	return db.Set(affectedRowsKey, rows), rows
+}
+
+// affectedRowsPlugin gorm plugin running statements with a RETURNING clause to learn which rows they wrote
+type affectedRowsPlugin struct{}
+
+func (p *affectedRowsPlugin) Name() string {
+	return "frame:affected_rows"
+}
+
+func (p *affectedRowsPlugin) Initialize(db *gorm.DB) error {
+
+	err := db.Callback().Create().Before("gorm:create").Register("frame:affected_rows_returning_create", p.returning(true))
+	if err != nil {
+		return err
+	}
+	err = db.Callback().Create().After("gorm:create").Register("frame:affected_rows_record_create", p.record)
+	if err != nil {
+		return err
+	}
+
+	err = db.Callback().Update().Before("gorm:update").Register("frame:affected_rows_returning_update", p.returning(false))
+	if err != nil {
+		return err
+	}
+	err = db.Callback().Update().After("gorm:update").Register("frame:affected_rows_record_update", p.record)
+	if err != nil {
+		return err
+	}
+
+	err = db.Callback().Delete().Before("gorm:delete").Register("frame:affected_rows_returning_delete", p.returning(false))
+	if err != nil {
+		return err
+	}
+	return db.Callback().Delete().After("gorm:delete").Register("frame:affected_rows_record_delete", p.record)
+}
+
+// requested reports whether the rows written by the statement are needed, for a session or lifecycle events
+func (p *affectedRowsPlugin) requested(db *gorm.DB) bool {
+	if _, ok := db.Get(affectedRowsKey); ok {
+		return true
+	}
+	_, ok := lifecycleEventModel(db)
+	return ok
+}
+
+// returning hands the statement a connection that appends a RETURNING clause when it is executed.
+// Statements carrying their own RETURNING clause are read by gorm and left alone.
+func (p *affectedRowsPlugin) returning(create bool) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		if db.Error != nil || db.DryRun || db.Statement.Schema == nil || !p.requested(db) {
+			return
+		}
+
+		if _, ok := db.Statement.Clauses["RETURNING"]; ok {
+			return
+		}
+
+		idField := db.Statement.Schema.LookUpField("id")
+		if idField == nil {
+			return
+		}
+
+		pool := &returningConnPool{ConnPool: db.Statement.ConnPool, created: create}
+		columns := []string{p.quote(db, idField.DBName)}
+		if field := db.Statement.Schema.LookUpField("tenant_id"); field != nil {
+			columns = append(columns, "COALESCE("+p.quote(db, field.DBName)+", '')")
+			pool.tenant = true
+		}
+		if field := db.Statement.Schema.LookUpField("version"); field != nil {
+			columns = append(columns, "COALESCE("+p.quote(db, field.DBName)+", 0)")
+			pool.version = true
+		}
+		if create {
+			// xmax is only set on the conflicting rows an upsert updated
+			columns = append(columns, "xmax = 0")
+		}
+		pool.returning = " RETURNING " + strings.Join(columns, ", ")
+
+		db.InstanceSet(affectedRowsKey, pool)
+		db.Statement.ConnPool = pool
+	}
+}
+
+func (p *affectedRowsPlugin) quote(db *gorm.DB, column string) string {
+	return db.Statement.Quote(clause.Column{Table: db.Statement.Table, Name: column})
+}
+
+// record restores the connection of the statement and keeps the rows it wrote
+func (p *affectedRowsPlugin) record(db *gorm.DB) {
+	value, ok := db.InstanceGet(affectedRowsKey)
+	if !ok {
+		return
+	}
+
+	pool := value.(*returningConnPool)
+	db.Statement.ConnPool = pool.ConnPool
+
+	if !pool.executed {
+		db.InstanceSet(affectedRowsKey, nil)
+		return
+	}
+
+	db.InstanceSet(affectedRowsKey, pool.rows)
+	if collector, ok := db.Get(affectedRowsKey); ok {
+		collector.(*affectedRows).add(pool.rows...)
+	}
+}
+
+// statementAffectedRows returns the rows written by the statement when they could be read from its RETURNING clause
+func statementAffectedRows(db *gorm.DB) ([]affectedRow, bool) {
+	value, ok := db.InstanceGet(affectedRowsKey)
+	if !ok {
+		return nil, false
+	}
+	rows, ok := value.([]affectedRow)
+	return rows, ok
+}
+
+// returningConnPool executes statements with a RETURNING clause recording the rows they wrote
+type returningConnPool struct {
+	gorm.ConnPool
+	returning string
+	tenant    bool
+	version   bool
+	created   bool
+
+	executed bool
+	rows     []affectedRow
+}
+
+func (p *returningConnPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	rows, err := p.ConnPool.QueryContext(ctx, query+p.returning, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	p.executed = true
+	for rows.Next() {
+		row := affectedRow{Created: p.created}
+		dest := []interface{}{&row.ID}
+		if p.tenant {
+			dest = append(dest, &row.TenantID)
+		}
+		if p.version {
+			dest = append(dest, &row.Version)
+		}
+		if p.created {
+			dest = append(dest, &row.Created)
+		}
+
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		p.rows = append(p.rows, row)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return returningResult(len(p.rows)), nil
+}
+
+// returningResult is the result of a statement executed by returningConnPool
+type returningResult int64
+
+func (r returningResult) LastInsertId() (int64, error) {
+	return 0, errors.New("last insert id is not supported, read the id from the returned rows")
+}
+
+func (r returningResult) RowsAffected() (int64, error) {
+	return int64(r), nil
+}
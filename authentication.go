@@ -29,14 +29,32 @@ type AuthenticationClaims struct {
 	PartitionID string   `json:"partition_id,omitempty"`
 	AccessID    string   `json:"access_id,omitempty"`
 	Roles       []string `json:"roles,omitempty"`
+	// PartitionSubtree grants access to all partitions nested below PartitionID
+	PartitionSubtree bool `json:"partition_subtree,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func (a *AuthenticationClaims) isSystem() bool {
-	//TODO: tokens which are granted as client credentials have no partition information attached
-	// Since we cannot pass custom information to token to allow specifying who is an admin.
-	// We will check if the subject starts with service. for now and make them system see: https://github.com/ory/hydra/issues/1748
-	return strings.HasPrefix(a.Subject, "service_")
+const ctxKeySystem = contextKey("systemKey")
+
+// AsSystem marks the supplied context as acting on behalf of the system.
+// Data accessed with such a context is not restricted to the tenant and partition of any authentication claims,
+// it should only be used for work that legitimately spans tenants like maintenance or cross tenant reporting.
+func AsSystem(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeySystem, true)
+}
+
+// IsSystem checks if the supplied context was marked as acting on behalf of the system using AsSystem
+func IsSystem(ctx context.Context) bool {
+	isSystem, ok := ctx.Value(ctxKeySystem).(bool)
+	return ok && isSystem
+}
+
+// withoutSystem clears the mark AsSystem left on the context, data is restricted to its claims again
+func withoutSystem(ctx context.Context) context.Context {
+	if !IsSystem(ctx) {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKeySystem, false)
 }
 
 // AsMetadata Creates a string map to be used as metadata in queue data
@@ -48,6 +66,9 @@ func (a *AuthenticationClaims) AsMetadata() map[string]string {
 	m["profile_id"] = a.ProfileID
 	m["access_id"] = a.AccessID
 	m["roles"] = strings.Join(a.Roles, ",")
+	if a.PartitionSubtree {
+		m["partition_subtree"] = "true"
+	}
 	return m
 }
 
@@ -84,6 +105,7 @@ func ClaimsFromMap(m map[string]string) *AuthenticationClaims {
 					authenticationClaims.AccessID = val
 					if val, ok := m["roles"]; ok {
 						authenticationClaims.Roles = strings.Split(val, ",")
+						authenticationClaims.PartitionSubtree = m["partition_subtree"] == "true"
 						return &authenticationClaims
 					}
 				}
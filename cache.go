@@ -0,0 +1,238 @@
+package frame
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	entityCacheDefaultTTL      = 5 * time.Minute
+	entityCacheDefaultCapacity = 10000
+
+	// EntityCacheInvalidationReference is the queue reference used to share cache invalidations between replicas
+	EntityCacheInvalidationReference = "frame.entity.cache.invalidation"
+)
+
+// CacheBackend stores the serialized entities cached by repositories.
+// Implementations must be safe for concurrent use, a missing or expired key is reported as not found.
+type CacheBackend interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+type memoryCacheEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// memoryCache is an in process least recently used cache whose entries also expire
+type memoryCache struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+// NewMemoryCache creates an in memory CacheBackend holding at most capacity entries,
+// the least recently used entry is evicted once it is full.
+func NewMemoryCache(capacity int) CacheBackend {
+	if capacity <= 0 {
+		capacity = entityCacheDefaultCapacity
+	}
+
+	return &memoryCache{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (mc *memoryCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	element, ok := mc.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	entry := element.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		mc.order.Remove(element)
+		delete(mc.entries, key)
+		return nil, false, nil
+	}
+
+	mc.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+func (mc *memoryCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	expiresAt := time.Now().Add(ttl)
+
+	if element, ok := mc.entries[key]; ok {
+		entry := element.Value.(*memoryCacheEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		mc.order.MoveToFront(element)
+		return nil
+	}
+
+	mc.entries[key] = mc.order.PushFront(&memoryCacheEntry{key: key, value: value, expiresAt: expiresAt})
+
+	for mc.order.Len() > mc.capacity {
+		oldest := mc.order.Back()
+		mc.order.Remove(oldest)
+		delete(mc.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+
+	return nil
+}
+
+func (mc *memoryCache) Delete(_ context.Context, keys ...string) error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	for _, key := range keys {
+		if element, ok := mc.entries[key]; ok {
+			mc.order.Remove(element)
+			delete(mc.entries, key)
+		}
+	}
+	return nil
+}
+
+type entityCache struct {
+	service      *Service
+	backend      CacheBackend
+	ttl          time.Duration
+	invalidation bool
+}
+
+type entityCacheInvalidation struct {
+	Keys []string `json:"keys"`
+}
+
+// WithEntityCache Option enables caching of entities read by repositories created with WithCache.
+// A nil backend uses an in memory least recently used cache, entries live for the ttl which is 5 minutes by default.
+func WithEntityCache(backend CacheBackend, ttl time.Duration) Option {
+	return func(s *Service) {
+		if backend == nil {
+			backend = NewMemoryCache(entityCacheDefaultCapacity)
+		}
+
+		if ttl <= 0 {
+			ttl = entityCacheDefaultTTL
+		}
+
+		s.dataStore.cache = &entityCache{
+			service: s,
+			backend: backend,
+			ttl:     ttl,
+		}
+	}
+}
+
+// WithEntityCacheInvalidation Option shares cache invalidations between replicas of the service.
+// Every change made through a cached repository is published on the topic and every replica
+// drops the entry from its cache when it receives the message on its subscription.
+func WithEntityCacheInvalidation(topicURL string, subscriptionURL string) Option {
+	return func(s *Service) {
+		if s.dataStore.cache == nil {
+			WithEntityCache(nil, 0)(s)
+		}
+
+		s.dataStore.cache.invalidation = true
+
+		RegisterPublisher(EntityCacheInvalidationReference, topicURL)(s)
+		RegisterSubscriber(EntityCacheInvalidationReference, subscriptionURL, 1,
+			&entityCacheInvalidationHandler{cache: s.dataStore.cache})(s)
+	}
+}
+
+// key identifies an entity of a table within a tenant, an empty tenant is used for lookups made without claims
+func (c *entityCache) key(tenantID string, table string, id string) string {
+	return tenantID + "/" + table + "/" + id
+}
+
+// entityKeys lists the keys the entities of a table may be cached under,
+// within their tenant and for lookups made without claims
+func (c *entityCache) entityKeys(tenantID string, table string, ids ...string) []string {
+	var keys []string
+	for _, id := range ids {
+		keys = append(keys, c.key("", table, id))
+		if tenantID != "" {
+			keys = append(keys, c.key(tenantID, table, id))
+		}
+	}
+	return keys
+}
+
+func (c *entityCache) get(ctx context.Context, key string, result interface{}) bool {
+	value, ok, err := c.backend.Get(ctx, key)
+	if err != nil {
+		c.service.L().WithError(err).WithField("key", key).Warn("could not read from the entity cache")
+		return false
+	}
+
+	if !ok {
+		return false
+	}
+
+	return json.Unmarshal(value, result) == nil
+}
+
+func (c *entityCache) set(ctx context.Context, key string, entity interface{}) {
+	value, err := json.Marshal(entity)
+	if err != nil {
+		return
+	}
+
+	err = c.backend.Set(ctx, key, value, c.ttl)
+	if err != nil {
+		c.service.L().WithError(err).WithField("key", key).Warn("could not write to the entity cache")
+	}
+}
+
+// invalidate drops the keys locally and asks the other replicas to do the same
+func (c *entityCache) invalidate(ctx context.Context, keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	err := c.backend.Delete(ctx, keys...)
+	if err != nil {
+		c.service.L().WithError(err).Warn("could not invalidate the entity cache")
+	}
+
+	if !c.invalidation {
+		return
+	}
+
+	err = c.service.Publish(ctx, EntityCacheInvalidationReference, &entityCacheInvalidation{Keys: keys})
+	if err != nil {
+		c.service.L().WithError(err).Warn("could not publish entity cache invalidation")
+	}
+}
+
+type entityCacheInvalidationHandler struct {
+	cache *entityCache
+}
+
+func (h *entityCacheInvalidationHandler) Handle(ctx context.Context, _ map[string]string, message []byte) error {
+	var invalidation entityCacheInvalidation
+	err := json.Unmarshal(message, &invalidation)
+	if err != nil {
+		return err
+	}
+
+	return h.cache.backend.Delete(ctx, invalidation.Keys...)
+}
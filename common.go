@@ -45,7 +45,7 @@ func (model *BaseModel) GenID(ctx context.Context) {
 	model.ID = xid.New().String()
 
 	authClaim := ClaimsFromContext(ctx)
-	if authClaim == nil || authClaim.isSystem() {
+	if authClaim == nil || IsSystem(ctx) {
 		return
 	}
 
@@ -97,9 +97,12 @@ func (model *BaseModel) BeforeUpdate(db *gorm.DB) error {
 type Migration struct {
 	BaseModel
 
-	Name      string `gorm:"type:varchar(50);uniqueIndex:idx_migrations_name"`
-	Patch     string `gorm:"type:text"`
-	AppliedAt sql.NullTime
+	Namespace   string `gorm:"type:varchar(100);uniqueIndex:idx_migrations_namespace_name"`
+	Name        string `gorm:"type:varchar(50);uniqueIndex:idx_migrations_namespace_name"`
+	Patch       string `gorm:"type:text"`
+	RevertPatch string `gorm:"type:text"`
+	Checksum    string `gorm:"type:varchar(64)"`
+	AppliedAt   sql.NullTime
 }
 
 // GetIp convenience method to extract the remote ip address from our inbound request
@@ -46,6 +46,8 @@ type ConfigurationDefault struct {
 	DatabaseReplicaURL    string `envconfig:"REPLICA_DATABASE_URL"`
 	DatabaseMigrate       string `default:"false" envconfig:"DO_MIGRATION"`
 	DatabaseMigrationPath string `default:"./migrations/0001" envconfig:"MIGRATION_PATH"`
+	DatabaseSeed          string `default:"false" envconfig:"DO_SEED"`
+	DatabaseSeedPath      string `default:"./seeds" envconfig:"SEED_PATH"`
 
 	EventsQueueName string `default:"frame.events.internal_._queue" envconfig:"EVENTS_QUEUE_NAME"`
 	EventsQueueUrl  string `default:"mem://frame.events.internal_._queue" envconfig:"EVENTS_QUEUE_URL"`
@@ -184,6 +186,25 @@ func (c *ConfigurationDefault) GetDatabaseMigrationPath() string {
 	return c.DatabaseMigrationPath
 }
 
+type ConfigurationSeeding interface {
+	DoDatabaseSeed() bool
+	GetDatabaseSeedPath() string
+}
+
+func (c *ConfigurationDefault) DoDatabaseSeed() bool {
+	isSeed, err := strconv.ParseBool(c.DatabaseSeed)
+	if err != nil {
+		isSeed = false
+	}
+
+	stdArgs := os.Args[1:]
+	return isSeed || (len(stdArgs) > 0 && stdArgs[0] == "seed")
+}
+
+func (c *ConfigurationDefault) GetDatabaseSeedPath() string {
+	return c.DatabaseSeedPath
+}
+
 type ConfigurationEvents interface {
 	GetEventsQueueName() string
 	GetEventsQueueUrl() string
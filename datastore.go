@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/stdlib"
 	"gocloud.dev/server/health/sqlhealth"
@@ -13,23 +14,60 @@ import (
 	"gorm.io/gorm"
 	"log"
 	"math/rand"
+	"sync"
+	"time"
 )
 
 type store struct {
-	writeDatabase []*gorm.DB
-	readDatabase  []*gorm.DB
+	writeDatabase    []*gorm.DB
+	readDatabase     []*gorm.DB
+	rowLevelSecurity bool
+	partitions       *partitionHierarchy
+	ownershipRoles   []string
+	routing          *tenantRouter
+	encryption       *encryptionKeyring
+	cache            *entityCache
+
+	migrationSources          []migrationSource
+	migrationNamespace        string
+	serviceMigrationNamespace bool
+	goMigrations              []goMigration
+	seedModels                []namedModel
+	tenantModels              []namedModel
+	failOnMigrationDrift      bool
+
+	sessionConfigured sync.Map
+
+	slowQueryThreshold time.Duration
 }
 
-func tenantPartition(ctx context.Context) func(db *gorm.DB) *gorm.DB {
+// tenantClaims returns the claims in the context only when they should restrict data access to a tenant
+func tenantClaims(ctx context.Context) *AuthenticationClaims {
+	if IsSystem(ctx) {
+		return nil
+	}
+
+	authClaim := ClaimsFromContext(ctx)
+	if authClaim != nil &&
+		authClaim.TenantID != "" &&
+		authClaim.PartitionID != "" {
+		return authClaim
+	}
+	return nil
+}
+
+func tenantPartition(ctx context.Context, st *store) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
-		authClaim := ClaimsFromContext(ctx)
-		if authClaim != nil &&
-			authClaim.TenantID != "" &&
-			authClaim.PartitionID != "" &&
-			!authClaim.isSystem() {
-			return db.Where("tenant_id = ? AND partition_id = ?", authClaim.TenantID, authClaim.PartitionID)
+		authClaim := tenantClaims(ctx)
+		if authClaim == nil {
+			return db
 		}
-		return db
+
+		partitions := st.accessiblePartitions(ctx, authClaim)
+		if len(partitions) == 1 {
+			return db.Where("tenant_id = ? AND partition_id = ?", authClaim.TenantID, partitions[0])
+		}
+		return db.Where("tenant_id = ? AND partition_id IN ?", authClaim.TenantID, partitions)
 	}
 }
 
@@ -98,9 +136,47 @@ func DBErrorIsRecordNotFound(err error) bool {
 	return errors.Is(err, gorm.ErrRecordNotFound)
 }
 
+const ctxKeyTransaction = contextKey("transactionKey")
+
 // DB obtains an already instantiated db connection with the option
-// to specify if you want write or read only db connection
+// to specify if you want write or read only db connection.
+// When the context carries a transaction started by DBTransaction that transaction is used instead.
 func (s *Service) DB(ctx context.Context, readOnly bool) *gorm.DB {
+
+	if tx, ok := ctx.Value(ctxKeyTransaction).(*gorm.DB); ok {
+		return tx.WithContext(ctx).Scopes(tenantPartition(ctx, s.dataStore))
+	}
+
+	db := s.dbConnection(ctx, readOnly)
+	if db == nil {
+		log.Printf("DB -- attempting use a database when none is setup")
+		return nil
+	}
+
+	return db.WithContext(ctx).Scopes(tenantPartition(ctx, s.dataStore))
+}
+
+// dbConnection picks the connection pool holding the data of the tenant in the context without applying any scopes,
+// the connection pinned for that database by withPinnedConnection is used instead when there is one
+func (s *Service) dbConnection(ctx context.Context, readOnly bool) *gorm.DB {
+	var db *gorm.DB
+	if s.dataStore.routing != nil {
+		db = s.dataStore.routing.connection(ctx, readOnly)
+	}
+	if db == nil {
+		db = s.defaultConnection(readOnly)
+	}
+
+	if db != nil {
+		if pinned := pinnedConnectionFor(ctx, db); pinned != nil {
+			return pinned
+		}
+	}
+	return db
+}
+
+// defaultConnection picks one of the configured connection pools
+func (s *Service) defaultConnection(readOnly bool) *gorm.DB {
 	var db *gorm.DB
 
 	if readOnly {
@@ -117,7 +193,6 @@ func (s *Service) DB(ctx context.Context, readOnly bool) *gorm.DB {
 	if db == nil {
 		writeCount := len(s.dataStore.writeDatabase)
 		if writeCount == 0 {
-			log.Printf("DB -- attempting use a database when none is setup")
 			return nil
 		}
 
@@ -128,7 +203,35 @@ func (s *Service) DB(ctx context.Context, readOnly bool) *gorm.DB {
 		db = s.dataStore.writeDatabase[randomIndex]
 	}
 
-	return db.WithContext(ctx).Scopes(tenantPartition(ctx))
+	return db
+}
+
+// DBTransaction runs the supplied function within a single database transaction.
+// The context handed to the function carries the transaction so that any call to DB made with it
+// participates in the same unit of work. The transaction is committed only if the function returns no error.
+// Nested calls reuse the transaction already present in the context.
+// Lifecycle events of the changes made are emitted once the transaction commits.
+func (s *Service) DBTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+
+	return s.dbTransaction(ctx, false, fn)
+}
+
+// dbTransaction runs fn within a transaction begun with the options on the connection picked for readOnly,
+// nested calls reuse the transaction already present in the context whatever its options
+func (s *Service) dbTransaction(ctx context.Context, readOnly bool, fn func(ctx context.Context) error, opts ...*sql.TxOptions) error {
+
+	if _, ok := ctx.Value(ctxKeyTransaction).(*gorm.DB); ok {
+		return fn(ctx)
+	}
+
+	db := s.dbConnection(ctx, readOnly)
+	if db == nil {
+		return errors.New("no database is setup to run a transaction")
+	}
+
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(context.WithValue(tx.Statement.Context, ctxKeyTransaction, tx))
+	}, opts...)
 }
 
 // DatastoreCon Option method to store a connection that will be utilized when connecting to the database
@@ -136,8 +239,9 @@ func DatastoreCon(postgresqlConnection string, readOnly bool) Option {
 	return func(s *Service) {
 		if s.dataStore == nil {
 			s.dataStore = &store{
-				writeDatabase: []*gorm.DB{},
-				readDatabase:  []*gorm.DB{},
+				writeDatabase:      []*gorm.DB{},
+				readDatabase:       []*gorm.DB{},
+				slowQueryThreshold: defaultSlowQueryThreshold,
 			}
 		}
 
@@ -149,19 +253,12 @@ func DatastoreCon(postgresqlConnection string, readOnly bool) Option {
 			s.dataStore.readDatabase = []*gorm.DB{}
 		}
 
-		config, err := pgx.ParseConfig(postgresqlConnection)
+		gormDB, db, err := s.openDatastore(postgresqlConnection)
 		if err != nil {
-			log.Printf("Datastore -- problem parsing database connection : %s", err)
+			log.Printf("Datastore -- problem opening database connection : %s", err)
+			return
 		}
 
-		db := stdlib.OpenDB(*config)
-		gormDB, _ := gorm.Open(
-			postgres.New(postgres.Config{Conn: db, PreferSimpleProtocol: true}),
-			&gorm.Config{SkipDefaultTransaction: true},
-		)
-
-		//_ = gormDB.Use(tracing.NewPlugin())
-
 		s.AddCleanupMethod(func(ctx context.Context) {
 			_ = db.Close()
 		})
@@ -176,6 +273,62 @@ func DatastoreCon(postgresqlConnection string, readOnly bool) Option {
 	}
 }
 
+// openDatastore connects to the supplied database and registers the plugins frame relies on.
+// Connections are established lazily so an unreachable database is not an error.
+func (s *Service) openDatastore(postgresqlConnection string) (*gorm.DB, *sql.DB, error) {
+	config, err := pgx.ParseConfig(postgresqlConnection)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse database connection : %w", err)
+	}
+
+	db := stdlib.OpenDB(*config, stdlib.OptionResetSession(s.dataStore.resetSession))
+	gormDB, err := gorm.Open(
+		postgres.New(postgres.Config{Conn: &hookedConnPool{DB: db}, PreferSimpleProtocol: true}),
+		&gorm.Config{SkipDefaultTransaction: true, DisableAutomaticPing: true},
+	)
+	if err != nil {
+		_ = db.Close()
+		return nil, nil, fmt.Errorf("could not open database : %w", err)
+	}
+
+	err = gormDB.Use(&telemetryPlugin{service: s})
+	if err != nil {
+		log.Printf("Datastore -- problem enabling telemetry : %s", err)
+	}
+
+	err = gormDB.Use(&tenancyPlugin{store: s.dataStore})
+	if err != nil {
+		log.Printf("Datastore -- problem enabling tenant enforcement : %s", err)
+	}
+
+	err = gormDB.Use(&ownershipPlugin{store: s.dataStore})
+	if err != nil {
+		log.Printf("Datastore -- problem enabling access ownership : %s", err)
+	}
+
+	err = gormDB.Use(&encryptionPlugin{store: s.dataStore})
+	if err != nil {
+		log.Printf("Datastore -- problem enabling encryption : %s", err)
+	}
+
+	err = gormDB.Use(&sessionConfigPlugin{store: s.dataStore})
+	if err != nil {
+		log.Printf("Datastore -- problem enabling session configuration : %s", err)
+	}
+
+	err = gormDB.Use(&affectedRowsPlugin{})
+	if err != nil {
+		log.Printf("Datastore -- problem enabling affected row capture : %s", err)
+	}
+
+	err = gormDB.Use(&lifecycleEventsPlugin{service: s})
+	if err != nil {
+		log.Printf("Datastore -- problem enabling lifecycle events : %s", err)
+	}
+
+	return gormDB, db, nil
+}
+
 func Datastore(ctx context.Context) Option {
 	return func(s *Service) {
 		config, ok := s.Config().(ConfigurationDatabase)
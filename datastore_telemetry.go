@@ -0,0 +1,187 @@
+package frame
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	telemetryInstrumentationName = "github.com/pitabwire/frame/datastore"
+	telemetryStartKey            = "frame:telemetry_start"
+	telemetrySpanKey             = "frame:telemetry_span"
+
+	defaultSlowQueryThreshold = 500 * time.Millisecond
+)
+
+var (
+	sqlStringLiteral  = regexp.MustCompile(`'(?:[^']|'')*'`)
+	sqlNumericLiteral = regexp.MustCompile(`([^\w$.])-?\d+(?:\.\d+)?\b`)
+)
+
+// WithSlowQueryThreshold Option sets the duration after which database queries are logged as slow.
+// By default this is 500 milliseconds, a threshold of zero or less disables slow query logging.
+func WithSlowQueryThreshold(threshold time.Duration) Option {
+	return func(s *Service) {
+		s.dataStore.slowQueryThreshold = threshold
+	}
+}
+
+// sanitizeSQL strips literal values from a statement so that it can be recorded without leaking data
+func sanitizeSQL(sql string) string {
+	sql = sqlStringLiteral.ReplaceAllString(sql, "?")
+	return sqlNumericLiteral.ReplaceAllString(sql, "${1}?")
+}
+
+// telemetryPlugin gorm plugin that traces every database call, records its duration and affected rows
+// per table and operation and logs calls slower than the configured threshold
+type telemetryPlugin struct {
+	service  *Service
+	tracer   trace.Tracer
+	duration metric.Float64Histogram
+	rows     metric.Int64Histogram
+}
+
+func (p *telemetryPlugin) Name() string {
+	return "frame:telemetry"
+}
+
+func (p *telemetryPlugin) Initialize(db *gorm.DB) error {
+	p.tracer = otel.Tracer(telemetryInstrumentationName)
+
+	meter := otel.Meter(telemetryInstrumentationName)
+
+	var err error
+	p.duration, err = meter.Float64Histogram("db.client.duration",
+		metric.WithDescription("Duration of database calls"), metric.WithUnit("ms"))
+	if err != nil {
+		return err
+	}
+
+	p.rows, err = meter.Int64Histogram("db.client.rows",
+		metric.WithDescription("Rows returned or affected by database calls"), metric.WithUnit("{row}"))
+	if err != nil {
+		return err
+	}
+
+	type registrar interface {
+		Register(name string, fn func(*gorm.DB)) error
+	}
+
+	processors := []struct {
+		operation string
+		before    registrar
+		after     registrar
+	}{
+		{"INSERT", db.Callback().Create().Before("*"), db.Callback().Create().After("*")},
+		{"SELECT", db.Callback().Query().Before("*"), db.Callback().Query().After("*")},
+		{"UPDATE", db.Callback().Update().Before("*"), db.Callback().Update().After("*")},
+		{"DELETE", db.Callback().Delete().Before("*"), db.Callback().Delete().After("*")},
+		{"SELECT", db.Callback().Row().Before("*"), db.Callback().Row().After("*")},
+		{"", db.Callback().Raw().Before("*"), db.Callback().Raw().After("*")},
+	}
+
+	for _, processor := range processors {
+		err = processor.before.Register("frame:telemetry_before", p.before(processor.operation))
+		if err != nil {
+			return err
+		}
+		err = processor.after.Register("frame:telemetry_after", p.after(processor.operation))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// before starts a span for the database call and remembers when it started
+func (p *telemetryPlugin) before(operation string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx := db.Statement.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		name := "gorm"
+		if operation != "" {
+			name = "gorm." + strings.ToLower(operation)
+		}
+
+		ctx, span := p.tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemPostgreSQL))
+
+		db.Statement.Context = ctx
+		db.InstanceSet(telemetrySpanKey, span)
+		db.InstanceSet(telemetryStartKey, time.Now())
+	}
+}
+
+// after ends the span and records the metrics and slow query log of the database call
+func (p *telemetryPlugin) after(operation string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		startValue, ok := db.InstanceGet(telemetryStartKey)
+		if !ok {
+			return
+		}
+		elapsed := time.Since(startValue.(time.Time))
+
+		statement := sanitizeSQL(db.Statement.SQL.String())
+		if operation == "" {
+			operation = strings.ToUpper(strings.SplitN(strings.TrimSpace(statement), " ", 2)[0])
+		}
+
+		attributes := []attribute.KeyValue{
+			semconv.DBOperationKey.String(operation),
+			semconv.DBSQLTableKey.String(db.Statement.Table),
+		}
+
+		ctx := db.Statement.Context
+		if spanValue, ok := db.InstanceGet(telemetrySpanKey); ok {
+			span := spanValue.(trace.Span)
+			span.SetAttributes(attributes...)
+			span.SetAttributes(semconv.DBStatementKey.String(statement), attribute.Int64("db.rows_affected", db.RowsAffected))
+			if db.Error != nil && !DBErrorIsRecordNotFound(db.Error) {
+				span.RecordError(db.Error)
+				span.SetStatus(codes.Error, db.Error.Error())
+			}
+			span.End()
+		}
+
+		p.duration.Record(ctx, float64(elapsed)/float64(time.Millisecond), metric.WithAttributes(attributes...))
+		p.rows.Record(ctx, db.RowsAffected, metric.WithAttributes(attributes...))
+
+		threshold := p.service.dataStore.slowQueryThreshold
+		if threshold > 0 && elapsed > threshold {
+			logger := p.service.L().
+				WithField("duration", elapsed.String()).
+				WithField("operation", operation).
+				WithField("table", db.Statement.Table).
+				WithField("rows", db.RowsAffected).
+				WithField("sql", statement)
+
+			spanContext := trace.SpanContextFromContext(ctx)
+			if spanContext.HasTraceID() {
+				logger = logger.WithField("trace_id", spanContext.TraceID().String()).
+					WithField("span_id", spanContext.SpanID().String())
+			}
+
+			authClaim := ClaimsFromContext(ctx)
+			if authClaim != nil {
+				logger = logger.WithField("tenant_id", authClaim.TenantID).
+					WithField("partition_id", authClaim.PartitionID)
+			}
+
+			logger.Warn("slow database query")
+		}
+	}
+}
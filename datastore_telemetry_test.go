@@ -0,0 +1,53 @@
+package frame
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSanitizeSQL(t *testing.T) {
+
+	testcases := []struct {
+		name      string
+		statement string
+		sanitized string
+	}{
+		{
+			name:      "string literals",
+			statement: "SELECT * FROM profiles WHERE name = 'O''Brien' AND email = 'a@b.c'",
+			sanitized: "SELECT * FROM profiles WHERE name = ? AND email = ?",
+		},
+		{
+			name:      "numeric literals",
+			statement: "SELECT * FROM profiles WHERE age > 30 AND score = -1.5 LIMIT 10",
+			sanitized: "SELECT * FROM profiles WHERE age > ? AND score = ? LIMIT ?",
+		},
+		{
+			name:      "placeholders and identifiers are kept",
+			statement: `UPDATE "table_2" SET "v1" = $1 WHERE id = $2`,
+			sanitized: `UPDATE "table_2" SET "v1" = $1 WHERE id = $2`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			sanitized := sanitizeSQL(tc.statement)
+			if sanitized != tc.sanitized {
+				t.Errorf("expected %s but got %s", tc.sanitized, sanitized)
+			}
+		})
+	}
+}
+
+func TestWithSlowQueryThreshold(t *testing.T) {
+	_, srv := NewService("Test Srv")
+	if srv.dataStore.slowQueryThreshold != defaultSlowQueryThreshold {
+		t.Errorf("expected the default slow query threshold but got %s", srv.dataStore.slowQueryThreshold)
+		return
+	}
+
+	_, srv = NewService("Test Srv", WithSlowQueryThreshold(time.Second))
+	if srv.dataStore.slowQueryThreshold != time.Second {
+		t.Errorf("expected a slow query threshold of one second but got %s", srv.dataStore.slowQueryThreshold)
+	}
+}
@@ -0,0 +1,188 @@
+package frame
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gocloud.dev/pubsub"
+	"strconv"
+	"time"
+)
+
+const (
+	// DeliveryAttemptKey is the metadata key counting the deliveries of a message, the first delivery has none
+	DeliveryAttemptKey = "delivery_attempt"
+	// FirstDeliveredAtKey is the metadata key holding when a redelivered message failed for the first time
+	FirstDeliveredAtKey = "first_delivered_at"
+
+	// DeadLetterErrorKey is the metadata key holding the last error of a dead lettered message
+	DeadLetterErrorKey = "dead_letter_error"
+	// DeadLetterHandlerKey is the metadata key naming the handler that failed a dead lettered message
+	DeadLetterHandlerKey = "dead_letter_handler"
+	// DeadLetterSubscriberKey is the metadata key holding the reference of the subscriber that failed the message
+	DeadLetterSubscriberKey = "dead_letter_subscriber"
+	// DeadLetteredAtKey is the metadata key holding when the message was dead lettered
+	DeadLetteredAtKey = "dead_lettered_at"
+)
+
+// ErrRequeueReferenceRequired is returned when a subscriber publishing failed messages again has no requeue reference
+var ErrRequeueReferenceRequired = errors.New("subscribers requeueing failed messages need a requeue reference")
+
+type deadLetter struct {
+	reference        string
+	maxAttempts      int
+	requeueReference string
+}
+
+// WithDeadLetter SubscriberOption limits the deliveries of a message to maxAttempts.
+// A failed message is published again with its attempt count in the delivery_attempt metadata,
+// once the attempts are exhausted it is forwarded to the publisher with the dead letter reference
+// together with the last error, the handler and the timestamps of its first failure and of dead lettering.
+// Unless maxAttempts is 1 WithRequeueReference has to name where failed messages are published for another attempt.
+// The attempts of a retry policy registered with WithRetryPolicy take precedence over maxAttempts.
+func WithDeadLetter(deadLetterReference string, maxAttempts int) SubscriberOption {
+	return func(s *subscriber) {
+		if maxAttempts < 1 {
+			maxAttempts = 1
+		}
+
+		if s.deadLetter == nil {
+			s.deadLetter = &deadLetter{}
+		}
+		s.deadLetter.reference = deadLetterReference
+		s.deadLetter.maxAttempts = maxAttempts
+	}
+}
+
+// WithRequeueReference SubscriberOption sets the publisher reference or topic url failed messages are published to
+// for another attempt. The topic has to feed this subscription alone, requeueing on a topic other subscriptions read
+// would have them handle the message again.
+func WithRequeueReference(reference string) SubscriberOption {
+	return func(s *subscriber) {
+		if s.deadLetter == nil {
+			s.deadLetter = &deadLetter{}
+		}
+		s.deadLetter.requeueReference = reference
+	}
+}
+
+// deliveryAttempt reads the attempt count of a message, messages without one are on their first attempt
+func deliveryAttempt(metadata map[string]string) int {
+	attempt, err := strconv.Atoi(metadata[DeliveryAttemptKey])
+	if err != nil || attempt < 1 {
+		return 1
+	}
+	return attempt
+}
+
+// maxAttempts is the number of deliveries a message gets, the retry policy takes precedence over the dead letter
+func (s *subscriber) maxAttempts() int {
+	if s.retry != nil && s.retry.MaxAttempts > 0 {
+		return s.retry.MaxAttempts
+	}
+
+	if s.deadLetter != nil && s.deadLetter.maxAttempts > 0 {
+		return s.deadLetter.maxAttempts
+	}
+
+	return 1
+}
+
+// requeues reports whether failed messages are published again for another attempt rather than retried in process
+func (s *subscriber) requeues() bool {
+	return s.maxAttempts() > 1 && !s.retry.holdsMessages()
+}
+
+// checkRequeue refuses subscribers that would requeue failed messages without a requeue reference,
+// the topic of the subscription url may fan out to the subscriptions of other services
+func (s *subscriber) checkRequeue() error {
+	if s.requeues() && (s.deadLetter == nil || s.deadLetter.requeueReference == "") {
+		return fmt.Errorf("subscriber %s : %w", s.reference, ErrRequeueReferenceRequired)
+	}
+	return nil
+}
+
+// handleFailure requeues or dead letters a message the handler failed.
+// Without a retry policy or dead letter the message is nacked, as are exhausted messages without a dead letter.
+func (s *subscriber) handleFailure(ctx context.Context, msg *pubsub.Message, handleErr error) {
+
+	deadLetterReference := ""
+	requeueReference := ""
+	if s.deadLetter != nil {
+		deadLetterReference = s.deadLetter.reference
+		requeueReference = s.deadLetter.requeueReference
+	}
+
+	if s.retry == nil && deadLetterReference == "" {
+		if msg.Nackable() {
+			msg.Nack()
+		}
+		return
+	}
+
+	service := FromContext(ctx)
+	logger := service.L().WithField("name", s.reference)
+	now := time.Now().UTC()
+	attempt := deliveryAttempt(msg.Metadata)
+
+	metadata := make(map[string]string, len(msg.Metadata)+6)
+	for key, value := range msg.Metadata {
+		metadata[key] = value
+	}
+	delete(metadata, NotBeforeKey)
+
+	if metadata[FirstDeliveredAtKey] == "" {
+		metadata[FirstDeliveredAtKey] = now.Format(time.RFC3339Nano)
+	}
+
+	// Retries held in process that reached the hold limit carry on from the topic
+	retryable := attempt < s.maxAttempts() && s.retry.retryable(handleErr)
+	retry := retryable && requeueReference != ""
+
+	reference := requeueReference
+	if retry {
+		metadata[DeliveryAttemptKey] = strconv.Itoa(attempt + 1)
+		if s.retry != nil {
+			metadata[NotBeforeKey] = now.Add(s.retry.backoff(attempt)).Format(time.RFC3339Nano)
+		}
+	} else {
+		// Attempts that can not be requeued are left to the broker, as are messages without a dead letter
+		if retryable {
+			logger.WithError(handleErr).WithField("attempt", attempt).Warn("message left for the broker to deliver again")
+			if msg.Nackable() {
+				msg.Nack()
+			}
+			return
+		}
+
+		if deadLetterReference == "" {
+			logger.WithError(handleErr).WithField("attempt", attempt).Error("message can not be handled and has no dead letter")
+			if msg.Nackable() {
+				msg.Nack()
+			}
+			return
+		}
+
+		reference = deadLetterReference
+		metadata[DeadLetterErrorKey] = handleErr.Error()
+		metadata[DeadLetterHandlerKey] = fmt.Sprintf("%T", s.handler)
+		metadata[DeadLetterSubscriberKey] = s.reference
+		metadata[DeadLetteredAtKey] = now.Format(time.RFC3339Nano)
+	}
+
+	err := service.publishMessage(ctx, reference, msg.Body, metadata)
+	if err != nil {
+		logger.WithError(err).WithField("attempt", attempt).Error("could not forward failed message")
+		if msg.Nackable() {
+			msg.Nack()
+		}
+		return
+	}
+
+	if !retry {
+		logger.WithError(handleErr).WithField("attempt", attempt).
+			WithField("dead_letter", reference).Warn("message dead lettered")
+	}
+
+	msg.Ack()
+}
@@ -0,0 +1,348 @@
+package frame_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pitabwire/frame"
+	"sync"
+	"testing"
+	"time"
+)
+
+type failingHandler struct {
+	mutex    sync.Mutex
+	attempts []string
+}
+
+func (h *failingHandler) Handle(ctx context.Context, metadata map[string]string, message []byte) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.attempts = append(h.attempts, metadata[frame.DeliveryAttemptKey])
+	return context.DeadlineExceeded
+}
+
+type deadLetterRecorder struct {
+	messages chan map[string]string
+}
+
+func newDeadLetterRecorder() *deadLetterRecorder {
+	return &deadLetterRecorder{messages: make(chan map[string]string, 10)}
+}
+
+func (h *deadLetterRecorder) Handle(ctx context.Context, metadata map[string]string, message []byte) error {
+	h.messages <- metadata
+	return nil
+}
+
+// next waits for the next dead lettered message, it returns nil when none arrives in time
+func (h *deadLetterRecorder) next(timeout time.Duration) map[string]string {
+	select {
+	case metadata := <-h.messages:
+		return metadata
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestService_SubscriberDeadLetter(t *testing.T) {
+	failing := &failingHandler{}
+	recorder := newDeadLetterRecorder()
+
+	ctx, srv := frame.NewService("Test Srv", frame.NoopDriver(),
+		frame.RegisterPublisher("work", "mem://deadLetterWork"),
+		frame.RegisterPublisher("work-dead-letter", "mem://deadLetters"),
+		frame.RegisterSubscriber("work", "mem://deadLetterWork", 1, failing,
+			frame.WithDeadLetter("work-dead-letter", 3), frame.WithRequeueReference("work")),
+		frame.RegisterSubscriber("work-dead-letter", "mem://deadLetters", 1, recorder))
+
+	err := srv.Run(ctx, "")
+	if err != nil {
+		t.Errorf("We couldn't instantiate queue  %s", err)
+		return
+	}
+	defer srv.Stop(ctx)
+
+	err = srv.Publish(ctx, "work", []byte("doomed"))
+	if err != nil {
+		t.Errorf("We could not publish to topic that was registered %s", err)
+		return
+	}
+
+	metadata := recorder.next(5 * time.Second)
+	if metadata == nil || len(recorder.messages) != 0 {
+		t.Errorf("Expected the message to be dead lettered once but got %v", metadata)
+		return
+	}
+
+	failing.mutex.Lock()
+	attempts := failing.attempts
+	failing.mutex.Unlock()
+
+	if len(attempts) != 3 || attempts[0] != "" || attempts[2] != "3" {
+		t.Errorf("Expected three counted attempts but got %v", attempts)
+	}
+
+	if metadata[frame.DeadLetterErrorKey] != context.DeadlineExceeded.Error() ||
+		metadata[frame.DeadLetterSubscriberKey] != "work" ||
+		metadata[frame.DeadLetterHandlerKey] != "*frame_test.failingHandler" ||
+		metadata[frame.FirstDeliveredAtKey] == "" || metadata[frame.DeadLetteredAtKey] == "" {
+		t.Errorf("Dead letter metadata is incomplete : %v", metadata)
+	}
+}
+
+func TestService_SubscriberRetryPolicy(t *testing.T) {
+	failing := &failingHandler{}
+	recorder := newDeadLetterRecorder()
+
+	ctx, srv := frame.NewService("Test Srv", frame.NoopDriver(),
+		frame.RegisterPublisher("retried", "mem://retriedWork"),
+		frame.RegisterPublisher("retried-dead-letter", "mem://retriedDeadLetters"),
+		frame.RegisterSubscriber("retried", "mem://retriedWork", 1, failing,
+			frame.WithRetryPolicy(frame.RetryPolicy{MaxAttempts: 3, InitialBackoff: 100 * time.Millisecond, Multiplier: 2}),
+			frame.WithDeadLetter("retried-dead-letter", 0), frame.WithRequeueReference("retried")),
+		frame.RegisterSubscriber("retried-dead-letter", "mem://retriedDeadLetters", 1, recorder))
+
+	err := srv.Run(ctx, "")
+	if err != nil {
+		t.Errorf("We couldn't instantiate queue  %s", err)
+		return
+	}
+	defer srv.Stop(ctx)
+
+	started := time.Now()
+	err = srv.Publish(ctx, "retried", []byte("slowly doomed"))
+	if err != nil {
+		t.Errorf("We could not publish to topic that was registered %s", err)
+		return
+	}
+
+	if recorder.next(5*time.Second) == nil {
+		t.Errorf("Expected the message to be dead lettered after its retries")
+		return
+	}
+
+	failing.mutex.Lock()
+	attempts := len(failing.attempts)
+	failing.mutex.Unlock()
+
+	// Two delays of at least 80ms and 160ms once jitter is taken off
+	if attempts != 3 || time.Since(started) < 240*time.Millisecond {
+		t.Errorf("Expected three attempts spaced by the backoff but got %d in %s", attempts, time.Since(started))
+	}
+}
+
+type nonRetryableHandler struct {
+	mutex    sync.Mutex
+	attempts int
+}
+
+func (h *nonRetryableHandler) Handle(ctx context.Context, metadata map[string]string, message []byte) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.attempts++
+	return fmt.Errorf("malformed message : %w", frame.ErrNonRetryable)
+}
+
+func TestService_SubscriberHeldRetriesSkipNonRetryable(t *testing.T) {
+	handler := &nonRetryableHandler{}
+	recorder := newDeadLetterRecorder()
+
+	ctx, srv := frame.NewService("Test Srv", frame.NoopDriver(),
+		frame.RegisterPublisher("held", "mem://heldWork"),
+		frame.RegisterPublisher("held-dead-letter", "mem://heldDeadLetters"),
+		frame.RegisterSubscriber("held", "mem://heldWork", 1, handler,
+			frame.WithRetryPolicy(frame.RetryPolicy{MaxAttempts: 5, InitialBackoff: 10 * time.Millisecond, HoldMessage: true}),
+			frame.WithDeadLetter("held-dead-letter", 0)),
+		frame.RegisterSubscriber("held-dead-letter", "mem://heldDeadLetters", 1, recorder))
+
+	err := srv.Run(ctx, "")
+	if err != nil {
+		t.Errorf("We couldn't instantiate queue  %s", err)
+		return
+	}
+	defer srv.Stop(ctx)
+
+	err = srv.Publish(ctx, "held", []byte("malformed"))
+	if err != nil {
+		t.Errorf("We could not publish to topic that was registered %s", err)
+		return
+	}
+
+	deadLetter := recorder.next(5 * time.Second)
+
+	handler.mutex.Lock()
+	attempts := handler.attempts
+	handler.mutex.Unlock()
+
+	if attempts != 1 || deadLetter == nil {
+		t.Errorf("Non retryable errors should be dead lettered right away, got %d attempts and dead letter %v", attempts, deadLetter)
+	}
+}
+
+func TestService_SubscriberWithoutDeadLetterKeepsFailedMessages(t *testing.T) {
+	handler := &nonRetryableHandler{}
+
+	ctx, srv := frame.NewService("Test Srv", frame.NoopDriver(),
+		frame.RegisterPublisher("undead", "mem://undeadWork"),
+		frame.RegisterSubscriber("undead", "mem://undeadWork", 1, handler,
+			frame.WithRetryPolicy(frame.RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond}),
+			frame.WithRequeueReference("undead")))
+
+	err := srv.Run(ctx, "")
+	if err != nil {
+		t.Errorf("We couldn't instantiate queue  %s", err)
+		return
+	}
+	defer srv.Stop(ctx)
+
+	err = srv.Publish(ctx, "undead", []byte("malformed"))
+	if err != nil {
+		t.Errorf("We could not publish to topic that was registered %s", err)
+		return
+	}
+
+	// The message is nacked instead of acknowledged, so the broker delivers it again
+	attempts := 0
+	deadline := time.Now().Add(5 * time.Second)
+	for attempts < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		handler.mutex.Lock()
+		attempts = handler.attempts
+		handler.mutex.Unlock()
+	}
+
+	if attempts < 2 {
+		t.Errorf("A message failing without a dead letter should be redelivered, got %d attempts", attempts)
+	}
+}
+
+// firstAttemptFailingHandler fails the first delivery of the messages it is told to fail
+type firstAttemptFailingHandler struct {
+	failed  chan string
+	handled chan string
+}
+
+func (h *firstAttemptFailingHandler) Handle(ctx context.Context, metadata map[string]string, message []byte) error {
+	if string(message) == "fail" && metadata[frame.DeliveryAttemptKey] == "" {
+		h.failed <- string(message)
+		return errors.New("first attempt fails")
+	}
+
+	h.handled <- string(message)
+	return nil
+}
+
+func TestService_SubscriberDelayedRetriesHoldNoSlot(t *testing.T) {
+	handler := &firstAttemptFailingHandler{failed: make(chan string, 1), handled: make(chan string, 2)}
+
+	ctx, srv := frame.NewService("Test Srv", frame.NoopDriver(),
+		frame.RegisterPublisher("delayed", "mem://delayedWork"),
+		frame.RegisterSubscriber("delayed", "mem://delayedWork", 1, handler,
+			frame.WithRetryPolicy(frame.RetryPolicy{MaxAttempts: 2, InitialBackoff: 2 * time.Second, Jitter: 0.01}),
+			frame.WithRequeueReference("delayed")))
+
+	err := srv.Run(ctx, "")
+	if err != nil {
+		t.Errorf("We couldn't instantiate queue  %s", err)
+		return
+	}
+	defer srv.Stop(ctx)
+
+	err = srv.Publish(ctx, "delayed", []byte("fail"))
+	if err != nil {
+		t.Errorf("We could not publish to topic that was registered %s", err)
+		return
+	}
+
+	select {
+	case <-handler.failed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("The message to retry was not handled")
+		return
+	}
+
+	err = srv.Publish(ctx, "delayed", []byte("ok"))
+	if err != nil {
+		t.Errorf("We could not publish to topic that was registered %s", err)
+		return
+	}
+
+	// The only slot of the subscriber stays free while the retry waits for its backoff
+	select {
+	case message := <-handler.handled:
+		if message != "ok" {
+			t.Errorf("Expected the new message to be handled before the delayed retry but got %s", message)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("The new message waited for the delayed retry")
+	}
+
+	select {
+	case message := <-handler.handled:
+		if message != "fail" {
+			t.Errorf("Expected the delayed retry but got %s", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("The delayed retry was not handled")
+	}
+}
+
+func TestService_SubscriberRequeuesMessagesHeldTooLong(t *testing.T) {
+	for name, policy := range map[string]frame.RetryPolicy{
+		"delayed": {MaxAttempts: 2, InitialBackoff: time.Second, Jitter: 0.01, MaxHold: 200 * time.Millisecond},
+		"held": {MaxAttempts: 2, InitialBackoff: time.Second, Jitter: 0.01, MaxHold: 200 * time.Millisecond,
+			HoldMessage: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			handler := &firstAttemptFailingHandler{failed: make(chan string, 1), handled: make(chan string, 1)}
+			reference := "hold-limit-" + name
+
+			ctx, srv := frame.NewService("Test Srv", frame.NoopDriver(),
+				frame.RegisterPublisher(reference, "mem://"+reference),
+				frame.RegisterSubscriber(reference, "mem://"+reference, 1, handler,
+					frame.WithRetryPolicy(policy), frame.WithRequeueReference(reference)))
+
+			err := srv.Run(ctx, "")
+			if err != nil {
+				t.Errorf("We couldn't instantiate queue  %s", err)
+				return
+			}
+			defer srv.Stop(ctx)
+
+			started := time.Now()
+			err = srv.Publish(ctx, reference, []byte("fail"))
+			if err != nil {
+				t.Errorf("We could not publish to topic that was registered %s", err)
+				return
+			}
+
+			// The backoff outlasts the hold limit, so the message goes back to the topic until it is due
+			select {
+			case <-handler.handled:
+				if time.Since(started) < 900*time.Millisecond {
+					t.Errorf("The retry was handled before its backoff, after %s", time.Since(started))
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("The retry of a message held too long was not handled")
+			}
+
+			if len(handler.failed) != 1 {
+				t.Errorf("Expected a single failed attempt but got %d", len(handler.failed))
+			}
+		})
+	}
+}
+
+func TestService_SubscriberRequeueNeedsReference(t *testing.T) {
+	ctx, srv := frame.NewService("Test Srv", frame.NoopDriver(),
+		frame.RegisterPublisher("fanned-dead-letter", "mem://fannedDeadLetters"),
+		frame.RegisterSubscriber("fanned", "mem://fannedWork", 1, &failingHandler{},
+			frame.WithDeadLetter("fanned-dead-letter", 3)))
+
+	err := srv.Run(ctx, "")
+	defer srv.Stop(ctx)
+	if !errors.Is(err, frame.ErrRequeueReferenceRequired) {
+		t.Errorf("Subscribers requeueing on their own topic should be refused : %v", err)
+	}
+}
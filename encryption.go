@@ -0,0 +1,359 @@
+package frame
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocloud.dev/secrets"
+	_ "gocloud.dev/secrets/localsecrets"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"strings"
+)
+
+const (
+	// EncryptedSerializer is the gorm serializer that encrypts a column at rest, used as `gorm:"serializer:encrypted"`
+	EncryptedSerializer = "encrypted"
+
+	blindIndexTagKey = "blind_index"
+)
+
+const ctxKeyEncryption = contextKey("encryptionKey")
+
+// ErrBlindIndexKeyMissing is returned when a blind index is computed without a key set by WithBlindIndexKey
+var ErrBlindIndexKeyMissing = errors.New("no blind index key is configured")
+
+func init() {
+	schema.RegisterSerializer(EncryptedSerializer, encryptedSerializer{})
+}
+
+// encryptionKeyring holds the keepers able to decrypt stored values and the one used to encrypt new values
+type encryptionKeyring struct {
+	primaryKeyID  string
+	keepers       map[string]*secrets.Keeper
+	blindIndexKey []byte
+}
+
+// WithEncryptionKeeper Option registers a gocloud.dev/secrets keeper under a key id for encrypting model columns,
+// for example base64key:// urls of local keys in development and tests or a cloud kms in production.
+// The last registered keeper encrypts new values while earlier ones keep decrypting the values they wrote,
+// so keys are rotated by registering a new keeper after the existing ones.
+func WithEncryptionKeeper(ctx context.Context, keyID string, keeperURL string) Option {
+	return func(s *Service) {
+		if keyID == "" || strings.Contains(keyID, ":") {
+			s.L().WithField("key_id", keyID).Error("WithEncryptionKeeper -- key ids must be non empty and not contain a colon")
+			return
+		}
+
+		keeper, err := secrets.OpenKeeper(ctx, keeperURL)
+		if err != nil {
+			s.L().WithError(err).WithField("key_id", keyID).Error("WithEncryptionKeeper -- could not open keeper")
+			return
+		}
+
+		s.AddCleanupMethod(func(ctx context.Context) {
+			_ = keeper.Close()
+		})
+
+		keyring := s.dataStore.keyring()
+		keyring.keepers[keyID] = keeper
+		keyring.primaryKeyID = keyID
+	}
+}
+
+// WithBlindIndexKey Option sets the secret used to compute the deterministic blind indexes of encrypted columns.
+// A blind index column is a string field tagged `blind_index:"Email"` naming the field whose value it indexes,
+// it is filled on every save and lets encrypted values be found by equality using BlindIndex.
+func WithBlindIndexKey(key string) Option {
+	return func(s *Service) {
+		s.dataStore.keyring().blindIndexKey = []byte(key)
+	}
+}
+
+// keyring returns the encryption keyring of the store creating it on first use
+func (st *store) keyring() *encryptionKeyring {
+	if st.encryption == nil {
+		st.encryption = &encryptionKeyring{keepers: map[string]*secrets.Keeper{}}
+	}
+	return st.encryption
+}
+
+// BlindIndex computes the value stored in the blind index column named column for the supplied plain value.
+// Use it to look up rows by an encrypted value, for example Where("email_index = ?", index) with the index
+// returned for ("email_index", email). ErrBlindIndexKeyMissing is returned when no blind index key is set.
+func (s *Service) BlindIndex(column string, value string) (string, error) {
+	return s.dataStore.encryption.blindIndex(column, value)
+}
+
+// blindIndex keys the hmac with the column so that equal values do not correlate across columns.
+// An unkeyed hash could be reversed by hashing guesses, so no index is computed without a key.
+func (kr *encryptionKeyring) blindIndex(column string, value string) (string, error) {
+	if kr == nil || len(kr.blindIndexKey) == 0 {
+		return "", ErrBlindIndexKeyMissing
+	}
+
+	mac := hmac.New(sha256.New, kr.blindIndexKey)
+	mac.Write([]byte(column + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// encrypt seals the plaintext with the primary keeper, the key id is stored in front of the ciphertext
+func (kr *encryptionKeyring) encrypt(ctx context.Context, plaintext []byte) (string, error) {
+	keeper, ok := kr.keepers[kr.primaryKeyID]
+	if !ok {
+		return "", errors.New("no encryption keeper is configured")
+	}
+
+	ciphertext, err := keeper.Encrypt(ctx, plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	return kr.primaryKeyID + ":" + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// decrypt opens a value written by encrypt using the keeper of the key id stored with it
+func (kr *encryptionKeyring) decrypt(ctx context.Context, value string) ([]byte, error) {
+	keyID, encoded, found := strings.Cut(value, ":")
+	if !found {
+		return nil, errors.New("encrypted value does not carry a key id")
+	}
+
+	keeper, ok := kr.keepers[keyID]
+	if !ok {
+		return nil, fmt.Errorf("no encryption keeper is configured for key id %s", keyID)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	return keeper.Decrypt(ctx, ciphertext)
+}
+
+func keyringFromContext(ctx context.Context) (*encryptionKeyring, error) {
+	keyring, ok := ctx.Value(ctxKeyEncryption).(*encryptionKeyring)
+	if !ok || keyring == nil {
+		return nil, errors.New("no encryption keeper is configured")
+	}
+	return keyring, nil
+}
+
+// encryptedSerializer stores string fields as ciphertext and any other field as encrypted json.
+// Empty strings and nil values are stored as they are.
+type encryptedSerializer struct{}
+
+func (encryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+
+	var stored string
+	switch value := dbValue.(type) {
+	case nil:
+		return nil
+	case string:
+		stored = value
+	case []byte:
+		stored = string(value)
+	default:
+		return fmt.Errorf("unsupported encrypted value of type %T", dbValue)
+	}
+
+	if stored == "" {
+		return nil
+	}
+
+	keyring, err := keyringFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := keyring.decrypt(ctx, stored)
+	if err != nil {
+		return err
+	}
+
+	fieldValue := reflect.New(field.FieldType)
+	if field.FieldType.Kind() == reflect.String {
+		fieldValue.Elem().SetString(string(plaintext))
+	} else if err = json.Unmarshal(plaintext, fieldValue.Interface()); err != nil {
+		return err
+	}
+
+	field.ReflectValueOf(ctx, dst).Set(fieldValue.Elem())
+	return nil
+}
+
+func (encryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+
+	var plaintext []byte
+	switch value := fieldValue.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if value == "" {
+			return "", nil
+		}
+		plaintext = []byte(value)
+	default:
+		if reflectValue := reflect.ValueOf(fieldValue); reflectValue.Kind() == reflect.Ptr && reflectValue.IsNil() {
+			return nil, nil
+		}
+
+		var err error
+		plaintext, err = json.Marshal(fieldValue)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keyring, err := keyringFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyring.encrypt(ctx, plaintext)
+}
+
+// encryptionPlugin gorm plugin that hands the keyring to the encrypted serializer and fills blind index columns
+type encryptionPlugin struct {
+	store *store
+}
+
+func (p *encryptionPlugin) Name() string {
+	return "frame:encryption"
+}
+
+func (p *encryptionPlugin) Initialize(db *gorm.DB) error {
+
+	type registrar interface {
+		Register(name string, fn func(*gorm.DB)) error
+	}
+
+	for _, processor := range []registrar{
+		db.Callback().Create().Before("*"),
+		db.Callback().Query().Before("*"),
+		db.Callback().Update().Before("*"),
+		db.Callback().Delete().Before("*"),
+		db.Callback().Row().Before("*"),
+		db.Callback().Raw().Before("*"),
+	} {
+		err := processor.Register("frame:encryption_keyring", p.attachKeyring)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := db.Callback().Create().Before("gorm:create").Register("frame:encryption_blind_index_create", p.fillBlindIndexes)
+	if err != nil {
+		return err
+	}
+
+	return db.Callback().Update().Before("gorm:update").Register("frame:encryption_update", p.enforceUpdate)
+}
+
+// enforceUpdate fills the blind indexes of an update and encrypts values assigned through a map,
+// gorm only runs serializers for values held in a struct
+func (p *encryptionPlugin) enforceUpdate(db *gorm.DB) {
+	p.fillBlindIndexes(db)
+
+	assignments, ok := db.Statement.Dest.(map[string]interface{})
+	if !ok || db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+
+	for key, value := range assignments {
+		field := db.Statement.Schema.LookUpField(key)
+		if field == nil {
+			continue
+		}
+
+		if _, encrypted := field.Serializer.(encryptedSerializer); !encrypted {
+			continue
+		}
+
+		if _, isExpression := value.(clause.Expression); isExpression {
+			continue
+		}
+
+		ciphertext, err := encryptedSerializer{}.Value(db.Statement.Context, field, db.Statement.ReflectValue, value)
+		if err != nil {
+			_ = db.AddError(err)
+			return
+		}
+		assignments[key] = ciphertext
+	}
+}
+
+// attachKeyring makes the keyring reachable from the statement context used by the serializer
+func (p *encryptionPlugin) attachKeyring(db *gorm.DB) {
+	if p.store.encryption == nil {
+		return
+	}
+
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	db.Statement.Context = context.WithValue(ctx, ctxKeyEncryption, p.store.encryption)
+}
+
+// fillBlindIndexes computes the blind index columns from the plain values of the fields they index
+func (p *encryptionPlugin) fillBlindIndexes(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+
+	for _, indexField := range db.Statement.Schema.Fields {
+		sourceName, ok := indexField.Tag.Lookup(blindIndexTagKey)
+		if !ok || indexField.DBName == "" {
+			continue
+		}
+
+		sourceField := db.Statement.Schema.LookUpField(sourceName)
+		if sourceField == nil {
+			_ = db.AddError(fmt.Errorf("blind index %s refers to the unknown field %s", indexField.Name, sourceName))
+			return
+		}
+
+		if assignments, ok := db.Statement.Dest.(map[string]interface{}); ok {
+			for key, value := range assignments {
+				if db.Statement.Schema.LookUpField(key) != sourceField {
+					continue
+				}
+
+				index, err := p.store.encryption.blindIndex(indexField.DBName, fmt.Sprint(value))
+				if err != nil {
+					_ = db.AddError(err)
+					return
+				}
+				assignments[indexField.DBName] = index
+			}
+			continue
+		}
+
+		err := walkReflectValue(db.Statement.ReflectValue, func(value reflect.Value) error {
+			// ValueOf of a serialized field wraps it for the serializer, the plain value is read directly
+			source := sourceField.ReflectValueOf(db.Statement.Context, value)
+			if source.IsZero() {
+				return indexField.Set(db.Statement.Context, value, "")
+			}
+
+			index, err := p.store.encryption.blindIndex(indexField.DBName, fmt.Sprint(reflect.Indirect(source).Interface()))
+			if err != nil {
+				return err
+			}
+			return indexField.Set(db.Statement.Context, value, index)
+		})
+		if err != nil {
+			_ = db.AddError(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package frame
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/rs/xid"
+	"gorm.io/gorm"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	// ErasureCompletedEvent is emitted with the ErasureJob once all the data of an erasure request is erased
+	ErasureCompletedEvent = "frame.erasure.completed"
+
+	// ErasureJobPending is the status of an erasure job waiting to run
+	ErasureJobPending = "pending"
+	// ErasureJobRunning is the status of an erasure job that started, it resumes from its completed models
+	ErasureJobRunning = "running"
+	// ErasureJobCompleted is the status of an erasure job that erased everything
+	ErasureJobCompleted = "completed"
+
+	// ErasureDeleted is the audit action of rows that were hard deleted
+	ErasureDeleted = "deleted"
+	// ErasureAnonymised is the audit action of rows of an AnonymisableModel
+	ErasureAnonymised = "anonymised"
+
+	erasureJobRetries = 3
+	// erasureJobLease is how long a replica holds a running job before another one may take it over
+	erasureJobLease = 10 * time.Minute
+)
+
+// errErasureJobLost is returned within a job update once another run claimed the job
+var errErasureJobLost = errors.New("erasure job is claimed by another run")
+
+// ErasureRequest identifies the data to erase, rows matching all the ids supplied are erased
+type ErasureRequest struct {
+	TenantID    string `json:"tenant_id,omitempty"`
+	PartitionID string `json:"partition_id,omitempty"`
+	AccessID    string `json:"access_id,omitempty"`
+}
+
+// AnonymisableModel is implemented by models whose rows erasure anonymises instead of deleting,
+// for example to keep financial records. The columns returned are overwritten with the values supplied.
+type AnonymisableModel interface {
+	AnonymisedColumns() map[string]interface{}
+}
+
+// ErasureJob records the progress of an erasure request so that it can resume after a restart
+type ErasureJob struct {
+	BaseModel
+
+	SubjectTenantID    string `gorm:"type:varchar(50)"`
+	SubjectPartitionID string `gorm:"type:varchar(50)"`
+	SubjectAccessID    string `gorm:"type:varchar(50)"`
+	Status             string `gorm:"type:varchar(20);index"`
+	CompletedModels    string `gorm:"type:text"`
+	RowsErased         int64
+	Error              string `gorm:"type:text"`
+	CompletedAt        sql.NullTime
+	// ClaimID identifies the run holding the job until ClaimedUntil, so that replicas do not run it together
+	ClaimID      string `gorm:"type:varchar(50)"`
+	ClaimedUntil sql.NullTime
+}
+
+// ErasureAudit records the rows of a model erased by an erasure job
+type ErasureAudit struct {
+	BaseModel
+
+	JobID    string `gorm:"type:varchar(50);index"`
+	Model    string `gorm:"type:varchar(100)"`
+	Action   string `gorm:"type:varchar(20)"`
+	Rows     int64
+	ErasedAt time.Time
+}
+
+func (job *ErasureJob) request() ErasureRequest {
+	return ErasureRequest{TenantID: job.SubjectTenantID, PartitionID: job.SubjectPartitionID, AccessID: job.SubjectAccessID}
+}
+
+func (job *ErasureJob) completedModels() map[string]bool {
+	completed := map[string]bool{}
+	for _, name := range strings.Split(job.CompletedModels, ",") {
+		if name != "" {
+			completed[name] = true
+		}
+	}
+	return completed
+}
+
+// erasureJobContext keeps erasure jobs and their audit in the service database whatever the claims in the context
+func erasureJobContext(ctx context.Context) context.Context {
+	return withTenantRoute(AsSystem(ctx), "")
+}
+
+// RequestErasure records an erasure job for the data of a tenant, partition or access id and runs it in the background.
+// Every model registered with WithTenantDataModel is walked, dependents first, hard deleting the matching rows
+// or anonymising them for an AnonymisableModel. An ErasureAudit is written per model
+// and ErasureCompletedEvent is emitted once done.
+func (s *Service) RequestErasure(ctx context.Context, request ErasureRequest) (*ErasureJob, error) {
+
+	if request.TenantID == "" && request.PartitionID == "" && request.AccessID == "" {
+		return nil, errors.New("an erasure request needs a tenant, partition or access id")
+	}
+
+	db := s.DB(erasureJobContext(ctx), false)
+	if db == nil {
+		return nil, errors.New("no database is setup to record erasure jobs")
+	}
+
+	job := &ErasureJob{
+		SubjectTenantID:    request.TenantID,
+		SubjectPartitionID: request.PartitionID,
+		SubjectAccessID:    request.AccessID,
+		Status:             ErasureJobPending,
+	}
+
+	err := db.Create(job).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return job, s.submitErasureJob(ctx, job.ID)
+}
+
+// ResumeErasureJobs submits the erasure jobs that did not complete, typically called once the service runs
+func (s *Service) ResumeErasureJobs(ctx context.Context) error {
+
+	var jobs []*ErasureJob
+	err := s.DB(erasureJobContext(ctx), true).
+		Where("status IN ?", []string{ErasureJobPending, ErasureJobRunning}).Find(&jobs).Error
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		err = s.submitErasureJob(ctx, job.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) submitErasureJob(ctx context.Context, jobID string) error {
+	return s.SubmitJob(ctx, s.NewJobWithRetry(func(ctx context.Context) error {
+		return s.RunErasureJob(ctx, jobID)
+	}, erasureJobRetries))
+}
+
+// RunErasureJob runs the erasure job in the foreground, skipping the models it already completed.
+// A job already claimed by another replica is left to it.
+func (s *Service) RunErasureJob(ctx context.Context, jobID string) error {
+
+	jobCtx := erasureJobContext(ctx)
+
+	models, err := s.tenantModelOrder()
+	if err != nil {
+		return err
+	}
+
+	claimID, claimed, err := s.claimErasureJob(jobCtx, jobID)
+	if err != nil || !claimed {
+		return err
+	}
+
+	renewCtx, stopRenewing := context.WithCancel(jobCtx)
+	defer stopRenewing()
+	go s.renewErasureJob(renewCtx, jobID, claimID)
+
+	job := &ErasureJob{}
+	err = s.DB(jobCtx, false).First(job, "id = ?", jobID).Error
+	if err != nil {
+		s.releaseErasureJob(jobCtx, jobID, claimID, err)
+		return err
+	}
+
+	completed := job.completedModels()
+	logger := s.L().WithField("erasure_job", job.ID)
+
+	// Dependent models are erased before the models they refer to
+	for i := len(models) - 1; i >= 0; i-- {
+		model := models[i]
+		if completed[model.name] {
+			continue
+		}
+
+		action, rows, err := s.eraseModel(ctx, job.request(), model)
+		if err != nil {
+			logger.WithError(err).WithField("model", model.name).Error("could not erase model")
+			s.releaseErasureJob(jobCtx, jobID, claimID, err)
+			return err
+		}
+
+		err = s.DBTransaction(jobCtx, func(ctx context.Context) error {
+			result := s.DB(ctx, false).Model(&ErasureJob{}).Where("id = ? AND claim_id = ?", jobID, claimID).
+				UpdateColumns(map[string]interface{}{
+					"completed_models": gorm.Expr("COALESCE(completed_models, '') || ?", ","+model.name),
+					"rows_erased":      gorm.Expr("rows_erased + ?", rows),
+					"claimed_until":    time.Now().Add(erasureJobLease),
+				})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errErasureJobLost
+			}
+
+			return s.DB(ctx, false).Create(&ErasureAudit{
+				JobID:    job.ID,
+				Model:    model.name,
+				Action:   action,
+				Rows:     rows,
+				ErasedAt: time.Now(),
+			}).Error
+		})
+		if errors.Is(err, errErasureJobLost) {
+			logger.Warn("erasure job was taken over by another run")
+			return nil
+		}
+		if err != nil {
+			s.releaseErasureJob(jobCtx, jobID, claimID, err)
+			return err
+		}
+
+		completed[model.name] = true
+		logger.WithField("model", model.name).WithField("action", action).WithField("rows", rows).Info("erased model")
+	}
+
+	result := s.DB(jobCtx, false).Model(&ErasureJob{}).Where("id = ? AND claim_id = ?", jobID, claimID).
+		UpdateColumns(map[string]interface{}{
+			"status":        ErasureJobCompleted,
+			"error":         "",
+			"completed_at":  sql.NullTime{Time: time.Now(), Valid: true},
+			"claimed_until": sql.NullTime{},
+		})
+	if result.Error != nil {
+		s.releaseErasureJob(jobCtx, jobID, claimID, result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		logger.Warn("erasure job was taken over by another run")
+		return nil
+	}
+
+	err = s.DB(jobCtx, false).First(job, "id = ?", jobID).Error
+	if err != nil {
+		return err
+	}
+
+	// The data is erased whether or not anyone hears about it, services without events only log the failure
+	err = s.Emit(ctx, ErasureCompletedEvent, job)
+	if err != nil {
+		logger.WithError(err).Warn("could not emit erasure completed event")
+	}
+
+	return nil
+}
+
+// claimErasureJob marks the job running under a new claim, unless it completed or another run holds an unexpired claim
+func (s *Service) claimErasureJob(ctx context.Context, jobID string) (string, bool, error) {
+	claimID := xid.New().String()
+	now := time.Now()
+
+	result := s.DB(ctx, false).Model(&ErasureJob{}).
+		Where("id = ?", jobID).
+		Where("status = ? OR (status = ? AND (claimed_until IS NULL OR claimed_until < ?))",
+			ErasureJobPending, ErasureJobRunning, now).
+		UpdateColumns(map[string]interface{}{
+			"status":        ErasureJobRunning,
+			"claim_id":      claimID,
+			"claimed_until": now.Add(erasureJobLease),
+		})
+	if result.Error != nil {
+		return "", false, result.Error
+	}
+	return claimID, result.RowsAffected == 1, nil
+}
+
+// renewErasureJob extends the claim of a run while it erases, a long model would otherwise outlive the lease
+func (s *Service) renewErasureJob(ctx context.Context, jobID string, claimID string) {
+	ticker := time.NewTicker(erasureJobLease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.DB(ctx, false).Model(&ErasureJob{}).Where("id = ? AND claim_id = ?", jobID, claimID).
+				UpdateColumn("claimed_until", time.Now().Add(erasureJobLease)).Error
+			if err != nil {
+				s.L().WithError(err).WithField("erasure_job", jobID).Warn("could not renew the erasure job claim")
+			}
+		}
+	}
+}
+
+// releaseErasureJob records the failure of a run and gives up its claim so that a retry can take the job right away
+func (s *Service) releaseErasureJob(ctx context.Context, jobID string, claimID string, cause error) {
+	_ = s.DB(ctx, false).Model(&ErasureJob{}).Where("id = ? AND claim_id = ?", jobID, claimID).
+		UpdateColumns(map[string]interface{}{
+			"error":         cause.Error(),
+			"claimed_until": sql.NullTime{},
+		}).Error
+}
+
+// eraseModel erases the rows of the model matching the request in every datastore that can hold them
+func (s *Service) eraseModel(ctx context.Context, request ErasureRequest, model namedModel) (string, int64, error) {
+
+	instance := reflect.New(reflect.Indirect(reflect.ValueOf(model.model)).Type()).Interface()
+
+	action := ErasureDeleted
+	var anonymised map[string]interface{}
+	if anonymisable, ok := instance.(AnonymisableModel); ok {
+		action = ErasureAnonymised
+		anonymised = anonymisable.AnonymisedColumns()
+	}
+
+	var total int64
+	erase := func(ctx context.Context) error {
+		rows, err := s.eraseRows(ctx, request, instance, anonymised)
+		total += rows
+		return err
+	}
+
+	var err error
+	if request.TenantID != "" {
+		err = erase(withTenantRoute(AsSystem(ctx), request.TenantID))
+	} else {
+		err = s.eachDatastore(AsSystem(ctx), erase)
+	}
+
+	return action, total, err
+}
+
+// eraseRows deletes or anonymises the matching rows in batches ordered by id, each batch in its own transaction
+func (s *Service) eraseRows(ctx context.Context, request ErasureRequest, instance interface{}, anonymised map[string]interface{}) (int64, error) {
+
+	db := s.DB(ctx, false)
+	if db == nil {
+		return 0, errors.New("no database is setup to erase from")
+	}
+
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(instance); err != nil {
+		return 0, err
+	}
+
+	conditions := map[string]interface{}{}
+	for column, value := range map[string]string{
+		"tenant_id":    request.TenantID,
+		"partition_id": request.PartitionID,
+		"access_id":    request.AccessID,
+	} {
+		if value == "" {
+			continue
+		}
+
+		// Rows of models without the column can not be tied to the subject
+		if stmt.Schema.LookUpField(column) == nil {
+			return 0, nil
+		}
+		conditions[column] = value
+	}
+
+	tenantColumn := "'' AS tenant_id"
+	if stmt.Schema.LookUpField("tenant_id") != nil {
+		tenantColumn = "COALESCE(tenant_id, '') AS tenant_id"
+	}
+
+	var total int64
+	lastID := ""
+
+	for {
+		var rows []erasedRow
+		err := s.DB(ctx, false).Unscoped().Model(instance).Select("id, "+tenantColumn).Where(conditions).
+			Where("id > ?", lastID).Order("id").Limit(defaultRepositoryBatchSize).Scan(&rows).Error
+		if err != nil {
+			return total, err
+		}
+
+		if len(rows) == 0 {
+			return total, nil
+		}
+		lastID = rows[len(rows)-1].ID
+
+		ids := make([]string, 0, len(rows))
+		for _, row := range rows {
+			ids = append(ids, row.ID)
+		}
+
+		var erased int64
+		err = s.DBTransaction(ctx, func(ctx context.Context) error {
+			var result *gorm.DB
+			if anonymised != nil {
+				result = s.DB(ctx, false).Unscoped().Model(instance).Where("id IN ?", ids).UpdateColumns(anonymised)
+			} else {
+				result = s.DB(ctx, false).Unscoped().Where("id IN ?", ids).Delete(instance)
+			}
+
+			if result.Error != nil {
+				return result.Error
+			}
+			erased = result.RowsAffected
+
+			s.invalidateErasedRows(result, stmt.Schema.Table, rows)
+			return nil
+		})
+		if err != nil {
+			return total, fmt.Errorf("could not erase rows after %s : %w", lastID, err)
+		}
+		// Rows only count as erased once their batch committed
+		total += erased
+	}
+}
+
+// erasedRow identifies a row erased by an erasure job
+type erasedRow struct {
+	ID       string
+	TenantID string
+}
+
+// invalidateErasedRows drops the cached copies of the erased rows once the transaction db takes part in commits
+func (s *Service) invalidateErasedRows(db *gorm.DB, table string, rows []erasedRow) {
+	cache := s.dataStore.cache
+	if cache == nil {
+		return
+	}
+
+	var keys []string
+	for _, row := range rows {
+		keys = append(keys, cache.entityKeys(row.TenantID, table, row.ID)...)
+	}
+
+	ctx := db.Statement.Context
+	afterCommit(db, func() {
+		cache.invalidate(ctx, keys...)
+	})
+}
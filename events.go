@@ -86,7 +86,9 @@ func (eq *eventQueueHandler) Handle(ctx context.Context, header map[string]strin
 
 	eventHandler, ok := eq.service.eventRegistry[evtPyl.Name]
 	if !ok {
+		// Nothing in this service handles the event, redelivering it would not change that
 		eq.service.L().WithField("event", evtPyl.Name).Error("Could not get event from registry")
+		return nil
 	}
 
 	payLType := eventHandler.PayloadType()
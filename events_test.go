@@ -93,3 +93,61 @@ func TestService_EventsPublishingWorks(t *testing.T) {
 	srv.Stop(ctx)
 
 }
+
+type signallingEvent struct {
+	handled chan string
+}
+
+func (event *signallingEvent) Name() string {
+	return "signalling.event"
+}
+
+func (event *signallingEvent) PayloadType() interface{} {
+	pType := ""
+	return &pType
+}
+
+func (event *signallingEvent) Validate(ctx context.Context, payload interface{}) error {
+	return nil
+}
+
+func (event *signallingEvent) Execute(ctx context.Context, payload interface{}) error {
+	event.handled <- *payload.(*string)
+	return nil
+}
+
+func TestService_UnregisteredEventsAreSkipped(t *testing.T) {
+	var cfg frame.ConfigurationDefault
+	err := frame.ConfigProcess("", &cfg)
+	if err != nil {
+		t.Errorf("could not process configs %s", err)
+		return
+	}
+	testEvent := &signallingEvent{handled: make(chan string, 1)}
+
+	ctx, srv := frame.NewService("Test Srv", frame.RegisterEvents(testEvent), frame.Config(&cfg), frame.NoopDriver())
+	if err = srv.Run(ctx, ""); err != nil {
+		t.Errorf("Could not run service : %s", err)
+		return
+	}
+	defer srv.Stop(ctx)
+
+	err = srv.Emit(ctx, "unregistered.event", "ignored")
+	if err != nil {
+		t.Errorf("Could not emit the unregistered event : %s", err)
+	}
+
+	err = srv.Emit(ctx, testEvent.Name(), "handled")
+	if err != nil {
+		t.Errorf("Could not emit the event : %s", err)
+	}
+
+	select {
+	case payload := <-testEvent.handled:
+		if payload != "handled" {
+			t.Errorf("Unexpected payload %s", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Events following an unregistered one should still be handled")
+	}
+}
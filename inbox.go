@@ -0,0 +1,132 @@
+package frame
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"gocloud.dev/pubsub"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+const (
+	inboxMessageIDKey     = "message_id"
+	inboxDefaultRetention = 7 * 24 * time.Hour
+	inboxMaxSweepInterval = time.Hour
+)
+
+// InboxMessage records a message that was already handled by an idempotent subscriber
+type InboxMessage struct {
+	BaseModel
+
+	Subscriber  string    `gorm:"type:varchar(100);uniqueIndex:idx_inbox_messages_subscriber_message"`
+	MessageID   string    `gorm:"type:varchar(100);uniqueIndex:idx_inbox_messages_subscriber_message"`
+	ProcessedAt time.Time `gorm:"index"`
+}
+
+const ctxKeyMessageID = contextKey("messageIDKey")
+
+// WithMessageID returns a context whose published messages carry the supplied message id instead of a generated one,
+// publishing a message again with the same id lets idempotent subscribers recognise it as a duplicate
+func WithMessageID(ctx context.Context, messageID string) context.Context {
+	return context.WithValue(ctx, ctxKeyMessageID, messageID)
+}
+
+// messageIDFromContext returns the message id supplied with WithMessageID
+func messageIDFromContext(ctx context.Context) string {
+	messageID, _ := ctx.Value(ctxKeyMessageID).(string)
+	return messageID
+}
+
+type inbox struct {
+	retention time.Duration
+}
+
+// WithSubscriberInbox SubscriberOption that makes a subscriber idempotent.
+// Every handled message is recorded in the inbox table within the same transaction as the handler's work,
+// redelivered messages that are already recorded are acknowledged without calling the handler again.
+// Records older than the retention period are periodically removed, by default they are kept for 7 days.
+func WithSubscriberInbox(retention time.Duration) SubscriberOption {
+	return func(s *subscriber) {
+		if retention <= 0 {
+			retention = inboxDefaultRetention
+		}
+		s.inbox = &inbox{retention: retention}
+	}
+}
+
+// inboxMessageID identifies a message using the id in its metadata and falls back to a hash of its content
+func inboxMessageID(msg *pubsub.Message) string {
+	if msg.Metadata != nil {
+		if messageID, ok := msg.Metadata[inboxMessageIDKey]; ok && messageID != "" {
+			return messageID
+		}
+	}
+
+	sum := sha256.Sum256(msg.Body)
+	return hex.EncodeToString(sum[:])
+}
+
+// process runs the handler only if the message has not been recorded before.
+// The inbox record is written first so that concurrent deliveries of the same message wait on the unique index.
+func (ib *inbox) process(ctx context.Context, reference string, msg *pubsub.Message,
+	handle func(ctx context.Context) error) error {
+
+	service := FromContext(ctx)
+	messageID := inboxMessageID(msg)
+
+	return service.DBTransaction(ctx, func(ctx context.Context) error {
+
+		record := InboxMessage{
+			Subscriber:  reference,
+			MessageID:   messageID,
+			ProcessedAt: time.Now(),
+		}
+
+		result := service.DB(ctx, false).Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			service.L().WithField("name", reference).WithField("message_id", messageID).
+				Debug("skipping already processed message")
+			return nil
+		}
+
+		return handle(ctx)
+	})
+}
+
+// expire removes inbox records that are older than the retention period
+func (ib *inbox) expire(ctx context.Context, reference string) error {
+	service := FromContext(ctx)
+	return service.DB(ctx, false).Unscoped().
+		Where("subscriber = ? AND processed_at < ?", reference, time.Now().Add(-ib.retention)).
+		Delete(&InboxMessage{}).Error
+}
+
+// sweep periodically expires old inbox records until the context is canceled
+func (ib *inbox) sweep(ctx context.Context, reference string) {
+
+	interval := ib.retention
+	if interval > inboxMaxSweepInterval {
+		interval = inboxMaxSweepInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := ib.expire(ctx, reference)
+			if err != nil && !DBErrorIsRecordNotFound(err) {
+				FromContext(ctx).L().WithError(err).WithField("name", reference).
+					Warn("could not expire inbox messages")
+			}
+		}
+	}
+}
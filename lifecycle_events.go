@@ -0,0 +1,216 @@
+package frame
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"reflect"
+)
+
+const (
+	// ModelCreated is the suffix of the event emitted when a row of a LifecycleEventModel is created
+	ModelCreated = "created"
+	// ModelUpdated is the suffix of the event emitted when a row of a LifecycleEventModel is updated
+	ModelUpdated = "updated"
+	// ModelDeleted is the suffix of the event emitted when a row of a LifecycleEventModel is deleted
+	ModelDeleted = "deleted"
+)
+
+const skipLifecycleEventsKey = "frame:skip_lifecycle_events"
+
+// LifecycleEventModel is implemented by models whose changes are emitted as events.
+// A successful create, update or delete emits the event named by LifecycleEventName followed by
+// .created, .updated or .deleted, for example profile.updated, carrying a ModelEvent.
+// Events carry the primary keys of the rows the statement wrote, upserted rows that already existed emit .updated.
+// Changes made within a transaction, DBTransaction or gorm's own, are emitted only once the outermost transaction commits.
+type LifecycleEventModel interface {
+	LifecycleEventName() string
+}
+
+// ModelEvent is the payload of the events emitted for a LifecycleEventModel
+type ModelEvent struct {
+	ID            string   `json:"id"`
+	Version       uint     `json:"version,omitempty"`
+	ChangedFields []string `json:"changed_fields,omitempty"`
+}
+
+func (s *Service) emitLifecycleEvent(ctx context.Context, name string, payload *ModelEvent) {
+	err := s.Emit(ctx, name, payload)
+	if err != nil {
+		s.L().WithError(err).WithField("event", name).WithField("id", payload.ID).Warn("could not emit model event")
+	}
+}
+
+// lifecycleEventsPlugin gorm plugin emitting the events of LifecycleEventModel changes
+type lifecycleEventsPlugin struct {
+	service *Service
+}
+
+func (p *lifecycleEventsPlugin) Name() string {
+	return "frame:lifecycle_events"
+}
+
+func (p *lifecycleEventsPlugin) Initialize(db *gorm.DB) error {
+	// Statements wrapped in a transaction by the session configuration are only committed by its callback
+	err := db.Callback().Create().After("frame:session_commit_or_rollback").
+		Register("frame:lifecycle_events_create", p.collect(ModelCreated))
+	if err != nil {
+		return err
+	}
+
+	err = db.Callback().Update().After("frame:session_commit_or_rollback").
+		Register("frame:lifecycle_events_update", p.collect(ModelUpdated))
+	if err != nil {
+		return err
+	}
+
+	return db.Callback().Delete().After("frame:session_commit_or_rollback").
+		Register("frame:lifecycle_events_delete", p.collect(ModelDeleted))
+}
+
+// withoutLifecycleEvents returns a session whose changes emit no lifecycle events,
+// for writes that restore rows rather than change them like tenant imports
+func withoutLifecycleEvents(db *gorm.DB) *gorm.DB {
+	return db.Set(skipLifecycleEventsKey, true)
+}
+
+// lifecycleEventModel returns the model of the statement when its changes are emitted as events
+func lifecycleEventModel(db *gorm.DB) (LifecycleEventModel, bool) {
+	if db.Statement.Schema == nil {
+		return nil, false
+	}
+	if skip, _ := db.Get(skipLifecycleEventsKey); skip == true {
+		return nil, false
+	}
+	model, ok := reflect.New(db.Statement.Schema.ModelType).Interface().(LifecycleEventModel)
+	return model, ok
+}
+
+// collect builds the events of a statement, they are emitted once the transaction holding the statement commits
+func (p *lifecycleEventsPlugin) collect(operation string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		if db.Error != nil || db.RowsAffected == 0 {
+			return
+		}
+
+		model, ok := lifecycleEventModel(db)
+		if !ok {
+			return
+		}
+
+		type event struct {
+			name    string
+			payload *ModelEvent
+		}
+
+		var events []event
+		add := func(rowOperation string, id string, version uint) {
+			events = append(events, event{
+				name:    model.LifecycleEventName() + "." + rowOperation,
+				payload: &ModelEvent{ID: id, Version: version, ChangedFields: p.changedFields(db, rowOperation)},
+			})
+		}
+
+		ctx := db.Statement.Context
+
+		if rows, ok := statementAffectedRows(db); ok {
+			for _, row := range rows {
+				rowOperation := operation
+				if operation == ModelCreated && !row.Created {
+					rowOperation = ModelUpdated
+				}
+				add(rowOperation, row.ID, row.Version)
+			}
+		} else {
+			// Statements gorm reads a RETURNING clause of itself fill in the instances they were given
+			idField := db.Statement.Schema.LookUpField("id")
+			versionField := db.Statement.Schema.LookUpField("version")
+
+			_ = walkReflectValue(db.Statement.ReflectValue, func(value reflect.Value) error {
+				if idField == nil {
+					return nil
+				}
+
+				id, isZero := idField.ValueOf(ctx, value)
+				if isZero {
+					return nil
+				}
+
+				var version uint
+				if versionField != nil {
+					versionValue, _ := versionField.ValueOf(ctx, value)
+					version, _ = versionValue.(uint)
+				}
+
+				idValue, _ := id.(string)
+				add(operation, idValue, version)
+				return nil
+			})
+		}
+
+		afterCommit(db, func() {
+			for _, e := range events {
+				p.service.emitLifecycleEvent(ctx, e.name, e.payload)
+			}
+		})
+	}
+}
+
+// changedFields lists the columns written by the statement
+func (p *lifecycleEventsPlugin) changedFields(db *gorm.DB, operation string) []string {
+	if operation == ModelDeleted {
+		return nil
+	}
+
+	modelSchema := db.Statement.Schema
+	var fields []string
+
+	// Rows an upsert updated only get the columns of its conflict clause
+	if onConflict, ok := db.Statement.Clauses["ON CONFLICT"].Expression.(clause.OnConflict); ok && operation == ModelUpdated {
+		for _, assignment := range onConflict.DoUpdates {
+			fields = append(fields, assignment.Column.Name)
+		}
+		return fields
+	}
+
+	if assignments, ok := db.Statement.Dest.(map[string]interface{}); ok && operation == ModelUpdated {
+		for key := range assignments {
+			if field := modelSchema.LookUpField(key); field != nil {
+				fields = append(fields, field.DBName)
+			}
+		}
+		return fields
+	}
+
+	selectAll := operation == ModelCreated
+	for _, selected := range db.Statement.Selects {
+		if selected == "*" {
+			selectAll = true
+		} else if field := modelSchema.LookUpField(selected); field != nil {
+			fields = append(fields, field.DBName)
+		}
+	}
+
+	if len(fields) > 0 && !selectAll {
+		return fields
+	}
+
+	fields = nil
+	dest := reflect.Indirect(reflect.ValueOf(db.Statement.Dest))
+	for _, field := range modelSchema.Fields {
+		if field.DBName == "" {
+			continue
+		}
+
+		// Updates with a struct only write the fields that are set
+		if !selectAll && dest.Kind() == reflect.Struct && dest.Type() == modelSchema.ModelType {
+			if _, isZero := field.ValueOf(db.Statement.Context, dest); isZero {
+				continue
+			}
+		}
+
+		fields = append(fields, field.DBName)
+	}
+
+	return fields
+}
@@ -0,0 +1,89 @@
+package frame
+
+import (
+	"context"
+	"log"
+)
+
+const (
+	// goMigrationUpPatch is recorded as the patch of go migrations in the migrations table
+	goMigrationUpPatch = "-- frame:go-migration up"
+	// goMigrationDownPatch is recorded as the down script of go migrations that can be rolled back
+	goMigrationDownPatch = "-- frame:go-migration down"
+)
+
+// MigrationFunc is a migration implemented in go. The context carries the transaction of the migration,
+// so every call to Service.DB made with it is committed or rolled back together with the migration record.
+type MigrationFunc func(ctx context.Context) error
+
+type goMigration struct {
+	name string
+	up   MigrationFunc
+	down MigrationFunc
+}
+
+// WithGoMigration Option registers a migration implemented in go for data changes that need application logic,
+// such as backfills or re-encrypting columns. It is ordered by name together with the sql migration files
+// and tracked in the same migrations table, the optional down function allows rolling it back.
+func WithGoMigration(name string, up MigrationFunc, down MigrationFunc) Option {
+	return func(s *Service) {
+		s.dataStore.goMigrations = append(s.dataStore.goMigrations, goMigration{name: name, up: up, down: down})
+	}
+}
+
+// mergeGoMigrations adds the registered go migrations to the migration files, replacing files of the same name
+func (s *Service) mergeGoMigrations(files []migrationFile) []migrationFile {
+
+	if len(s.dataStore.goMigrations) == 0 {
+		return files
+	}
+
+	merged := make([]migrationFile, 0, len(files)+len(s.dataStore.goMigrations))
+	replaced := map[string]bool{}
+	for _, migration := range s.dataStore.goMigrations {
+		replaced[migration.name] = true
+	}
+
+	for _, file := range files {
+		if replaced[file.name] {
+			log.Printf("scanForNewMigrations -- go migration %s replaces the one from %s", file.name, file.source)
+			continue
+		}
+		merged = append(merged, file)
+	}
+
+	// A go migration registered again under the same name replaces the earlier registration
+	for i := len(s.dataStore.goMigrations) - 1; i >= 0; i-- {
+		migration := s.dataStore.goMigrations[i]
+		if !replaced[migration.name] {
+			continue
+		}
+		delete(replaced, migration.name)
+
+		file := migrationFile{name: migration.name, source: "go", patch: goMigrationUpPatch}
+		if migration.down != nil {
+			file.revertPatch = goMigrationDownPatch
+		}
+		merged = append(merged, file)
+	}
+
+	return merged
+}
+
+// goMigrationFunc finds the up or down function of the named go migration
+func (s *Service) goMigrationFunc(name string, down bool) MigrationFunc {
+
+	for i := len(s.dataStore.goMigrations) - 1; i >= 0; i-- {
+		migration := s.dataStore.goMigrations[i]
+		if migration.name != name {
+			continue
+		}
+
+		if down {
+			return migration.down
+		}
+		return migration.up
+	}
+
+	return nil
+}
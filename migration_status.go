@@ -0,0 +1,226 @@
+package frame
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// MigrationPending is the state of a migration that is yet to be applied
+	MigrationPending = "pending"
+	// MigrationApplied is the state of a migration applied from the file still in the migration sources
+	MigrationApplied = "applied"
+	// MigrationDrifted is the state of an applied migration whose file changed after it was applied
+	MigrationDrifted = "drifted"
+	// MigrationMissing is the state of a recorded migration whose file is no longer in the migration sources
+	MigrationMissing = "missing"
+)
+
+// ErrMigrationDrift is returned by MigrateDatastore when WithFailOnMigrationDrift is set
+// and applied migrations no longer match their files
+var ErrMigrationDrift = errors.New("applied migrations differ from their migration files")
+
+// MigrationStatus describes the state of a single migration
+type MigrationStatus struct {
+	Namespace string
+	Name      string
+	Source    string
+	State     string
+	Checksum  string
+	AppliedAt *time.Time
+}
+
+// WithFailOnMigrationDrift Option makes MigrateDatastore fail when an applied migration
+// was changed or removed from the migration sources since it was applied.
+func WithFailOnMigrationDrift() Option {
+	return func(s *Service) {
+		s.dataStore.failOnMigrationDrift = true
+	}
+}
+
+// migrationChecksum is the hex encoded sha256 of the migration patch
+func migrationChecksum(patch string) string {
+	sum := sha256.Sum256([]byte(patch))
+	return hex.EncodeToString(sum[:])
+}
+
+// recordedStatus reports the migrations recorded under the namespace without comparing them to any files
+func (m *migrator) recordedStatus(ctx context.Context, namespace string) ([]MigrationStatus, error) {
+
+	var recorded []*Migration
+	err := m.DB(ctx).Where("COALESCE(namespace, '') = ?", namespace).Order("name").Find(&recorded).Error
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(recorded))
+	for _, migration := range recorded {
+		statuses = append(statuses, recordStatus(migration))
+	}
+
+	return statuses, nil
+}
+
+// recordStatus is the state of a recorded migration as far as the record alone tells
+func recordStatus(migration *Migration) MigrationStatus {
+
+	status := MigrationStatus{
+		Namespace: migration.Namespace,
+		Name:      migration.Name,
+		State:     MigrationPending,
+		Checksum:  migration.Checksum,
+	}
+
+	if migration.AppliedAt.Valid {
+		appliedAt := migration.AppliedAt.Time
+		status.AppliedAt = &appliedAt
+		status.State = MigrationApplied
+	}
+
+	return status
+}
+
+// status compares the migrations recorded under the service namespace with the files of the sources ordered by name
+func (m *migrator) status(ctx context.Context, sources []migrationSource) ([]MigrationStatus, error) {
+
+	files, err := m.readMigrationFiles(sources)
+	if err != nil {
+		return nil, err
+	}
+
+	var recorded []*Migration
+	err = m.migrations(ctx).Find(&recorded).Error
+	if err != nil {
+		return nil, err
+	}
+
+	filesByName := map[string]migrationFile{}
+	for _, file := range files {
+		filesByName[file.name] = file
+	}
+
+	var statuses []MigrationStatus
+	for _, migration := range recorded {
+
+		status := recordStatus(migration)
+
+		file, ok := filesByName[migration.Name]
+		delete(filesByName, migration.Name)
+
+		switch {
+		case !ok:
+			status.State = MigrationMissing
+		case status.AppliedAt != nil && migration.Checksum != "" && migration.Checksum != migrationChecksum(file.patch):
+			status.State = MigrationDrifted
+		}
+		status.Source = file.source
+
+		statuses = append(statuses, status)
+	}
+
+	for _, file := range filesByName {
+		statuses = append(statuses, MigrationStatus{
+			Namespace: m.namespace(),
+			Name:      file.name,
+			Source:    file.source,
+			State:     MigrationPending,
+			Checksum:  migrationChecksum(file.patch),
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses, nil
+}
+
+// checkDrift fails with ErrMigrationDrift naming the applied migrations that were changed or removed
+func (m *migrator) checkDrift(ctx context.Context, sources []migrationSource) error {
+
+	statuses, err := m.status(ctx, sources)
+	if err != nil {
+		return err
+	}
+
+	var drifted []string
+	for _, status := range statuses {
+		if status.State == MigrationDrifted || (status.State == MigrationMissing && status.AppliedAt != nil) {
+			drifted = append(drifted, fmt.Sprintf("%s (%s)", status.Name, status.State))
+		}
+	}
+
+	if len(drifted) > 0 {
+		return fmt.Errorf("%w : %s", ErrMigrationDrift, strings.Join(drifted, ", "))
+	}
+
+	return nil
+}
+
+// MigrationStatus reports the state of the migrations recorded in the database resolved for the context
+// ordered by namespace and name. Without namespaces the migrations of the service namespace are compared
+// with the files in the migrations path, other namespaces are reported as recorded and * selects all of them.
+func (s *Service) MigrationStatus(ctx context.Context, migrationsDirPath string, namespaces ...string) ([]MigrationStatus, error) {
+
+	migrationExecutor := migrator{service: s}
+
+	if len(namespaces) == 0 {
+		namespaces = []string{migrationExecutor.namespace()}
+	}
+
+	if len(namespaces) == 1 && namespaces[0] == "*" {
+		namespaces = nil
+		err := migrationExecutor.DB(ctx).Model(&Migration{}).Distinct().
+			Order("COALESCE(namespace, '')").Pluck("COALESCE(namespace, '')", &namespaces).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var statuses []MigrationStatus
+	for _, namespace := range namespaces {
+
+		var namespaceStatuses []MigrationStatus
+		var err error
+		if namespace == migrationExecutor.namespace() {
+			namespaceStatuses, err = migrationExecutor.status(ctx, s.resolveMigrationSources(migrationsDirPath))
+		} else {
+			namespaceStatuses, err = migrationExecutor.recordedStatus(ctx, namespace)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		statuses = append(statuses, namespaceStatuses...)
+	}
+
+	return statuses, nil
+}
+
+func (s *Service) printMigrationStatus(ctx context.Context, migrationsDirPath string, out io.Writer, namespaces ...string) error {
+
+	statuses, err := s.MigrationStatus(ctx, migrationsDirPath, namespaces...)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(writer, "NAMESPACE\tNAME\tSTATE\tSOURCE\tAPPLIED AT")
+	for _, status := range statuses {
+		appliedAt := ""
+		if status.AppliedAt != nil {
+			appliedAt = status.AppliedAt.Format(time.RFC3339)
+		}
+		_, _ = fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", status.Namespace, status.Name, status.State, status.Source, appliedAt)
+	}
+
+	return writer.Flush()
+}
@@ -5,14 +5,105 @@ import (
 	"errors"
 	"fmt"
 	"gorm.io/gorm"
+	"io/fs"
 	"log"
 	"os"
-	"path/filepath"
+	"path"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const (
+	defaultMigrationPath = "./migrations/0001"
+
+	// MigrationNoTransactionMarker placed on its own line in a migration file runs the file outside a transaction,
+	// as required by statements such as CREATE INDEX CONCURRENTLY
+	MigrationNoTransactionMarker = "-- frame:no-transaction"
+
+	// migrationLockID is the postgres advisory lock serialising migration runs of all replicas
+	migrationLockID int64 = 0x6672616d65
+)
+
+// migrationSource is a named file system holding sql migration files at its root
+type migrationSource struct {
+	name string
+	fsys fs.FS
+}
+
+// WithMigrationNamespace Option sets the namespace recording the migrations of the service,
+// services sharing a database each need their own namespace. It defaults to the empty namespace
+// that holds the migrations recorded before namespaces existed.
+func WithMigrationNamespace(namespace string) Option {
+	return func(s *Service) {
+		s.dataStore.migrationNamespace = namespace
+	}
+}
+
+// WithServiceMigrationNamespace Option records the migrations of the service under the service name.
+// Renaming the service then starts a new namespace and applies every migration again, prefer WithMigrationNamespace.
+func WithServiceMigrationNamespace() Option {
+	return func(s *Service) {
+		s.dataStore.serviceMigrationNamespace = true
+	}
+}
+
+// migrationNamespace is the namespace of the service migrations, the empty namespace unless set explicitly
+func (s *Service) migrationNamespace() string {
+	if s.dataStore.migrationNamespace != "" {
+		return s.dataStore.migrationNamespace
+	}
+	if s.dataStore.serviceMigrationNamespace {
+		return s.Name()
+	}
+	return ""
+}
+
+// WithMigrationSource Option registers a named source of sql migration files such as an embed.FS.
+// The files have to be at the root of the source, use fs.Sub to select the directory holding them.
+// MigrateDatastore and the MIGRATION_PATH configuration refer to the source by its name
+// and when no path is supplied all registered sources are used in the order they were registered.
+func WithMigrationSource(name string, fsys fs.FS) Option {
+	return func(s *Service) {
+		s.dataStore.migrationSources = append(s.dataStore.migrationSources, migrationSource{name: name, fsys: fsys})
+	}
+}
+
+// resolveMigrationSources turns a comma separated list of registered source names and directories into migration sources
+func (s *Service) resolveMigrationSources(migrationsPath string) []migrationSource {
+
+	if strings.TrimSpace(migrationsPath) == "" {
+		if len(s.dataStore.migrationSources) > 0 {
+			return s.dataStore.migrationSources
+		}
+		migrationsPath = defaultMigrationPath
+	}
+
+	var sources []migrationSource
+	for _, entry := range strings.Split(migrationsPath, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		registered := false
+		for _, source := range s.dataStore.migrationSources {
+			if source.name == entry {
+				sources = append(sources, source)
+				registered = true
+				break
+			}
+		}
+
+		if !registered {
+			sources = append(sources, migrationSource{name: entry, fsys: os.DirFS(entry)})
+		}
+	}
+
+	return sources
+}
+
 type migrator struct {
 	service *Service
 }
@@ -21,42 +112,118 @@ func (m *migrator) DB(ctx context.Context) *gorm.DB {
 	return m.service.DB(ctx, false)
 }
 
-func (m *migrator) scanForNewMigrations(ctx context.Context, migrationsDirPath string) error {
+// namespace separates the migrations of services sharing a database
+func (m *migrator) namespace() string {
+	return m.service.migrationNamespace()
+}
 
-	// Get a list of migration files
-	files, err := filepath.Glob(migrationsDirPath + "/*.sql")
-	if err != nil {
-		return err
-	}
+// migrations queries the migrations recorded under the namespace of the service
+func (m *migrator) migrations(ctx context.Context) *gorm.DB {
+	return m.DB(ctx).Model(&Migration{}).Where("COALESCE(namespace, '') = ?", m.namespace())
+}
 
-	sort.Strings(files)
+type migrationFile struct {
+	name        string
+	source      string
+	patch       string
+	revertPatch string
+}
 
-	for _, file := range files {
-		filename := filepath.Base(file)
-		filename = strings.Replace(filename, ".sql", "", 1)
+// readMigrationFiles merges the sql files of the sources ordered by name,
+// a file of a later source replaces the file of the same name in an earlier one.
+// Files named NNNN_name.up.sql and NNNN_name.down.sql hold the patch and the down script of the migration NNNN_name.
+// Go migrations registered with WithGoMigration are ordered with the files and replace files of the same name.
+func (m *migrator) readMigrationFiles(sources []migrationSource) ([]migrationFile, error) {
 
-		migrationPatch, err := os.ReadFile(file)
+	filesByName := map[string]*migrationFile{}
+	hasPatch := map[string]bool{}
 
+	for _, source := range sources {
+		files, err := fs.Glob(source.fsys, "*.sql")
 		if err != nil {
-			log.Printf("scanForNewMigrations -- Problem reading migration file content : %s", err)
+			return nil, err
+		}
+
+		for _, file := range files {
+			migrationPatch, err := fs.ReadFile(source.fsys, file)
+			if err != nil {
+				log.Printf("scanForNewMigrations -- Problem reading migration file content : %s", err)
+				continue
+			}
+
+			name := strings.TrimSuffix(path.Base(file), ".sql")
+			isRevert := strings.HasSuffix(name, ".down")
+			name = strings.TrimSuffix(strings.TrimSuffix(name, ".down"), ".up")
+
+			existing, ok := filesByName[name]
+			if !ok {
+				existing = &migrationFile{name: name}
+				filesByName[name] = existing
+			}
+
+			if isRevert {
+				existing.revertPatch = string(migrationPatch)
+				continue
+			}
+
+			if hasPatch[name] {
+				log.Printf("scanForNewMigrations -- migration %s from %s replaces the one from %s", name, source.name, existing.source)
+			}
+			hasPatch[name] = true
+			existing.source = source.name
+			existing.patch = string(migrationPatch)
+		}
+	}
+
+	migrationFiles := make([]migrationFile, 0, len(filesByName))
+	for _, file := range filesByName {
+		if !hasPatch[file.name] {
+			log.Printf("scanForNewMigrations -- down script of %s has no matching up script and is ignored", file.name)
 			continue
 		}
+		migrationFiles = append(migrationFiles, *file)
+	}
+
+	migrationFiles = m.service.mergeGoMigrations(migrationFiles)
+
+	sort.Slice(migrationFiles, func(i, j int) bool {
+		return migrationFiles[i].name < migrationFiles[j].name
+	})
+
+	return migrationFiles, nil
+}
+
+func (m *migrator) scanForNewMigrations(ctx context.Context, sources []migrationSource) error {
+
+	files, err := m.readMigrationFiles(sources)
+	if err != nil {
+		return err
+	}
 
-		err = m.saveNewMigrations(ctx, filename, string(migrationPatch))
+	for _, file := range files {
+		err = m.saveMigration(ctx, file)
 		if err != nil {
-			log.Printf("scanForNewMigrations -- new migration :%s could not be processed because: %s", file, err)
+			log.Printf("scanForNewMigrations -- new migration :%s from %s could not be processed because: %s", file.name, file.source, err)
 			return err
 		}
-
 	}
 	return nil
 }
 
 func (m *migrator) saveNewMigrations(ctx context.Context, filename string, migrationPatch string) error {
+	return m.saveMigration(ctx, migrationFile{name: filename, patch: migrationPatch})
+}
+
+func (m *migrator) saveMigration(ctx context.Context, file migrationFile) error {
 
 	migration := Migration{}
+	checksum := migrationChecksum(file.patch)
+
+	err := m.migrations(ctx).First(&migration, "name = ?", file.name).Error
+	if err != nil && DBErrorIsRecordNotFound(err) && m.namespace() != "" {
+		err = m.claimLegacyMigration(ctx, &migration, file.name, checksum)
+	}
 
-	err := m.DB(ctx).Model(&migration).First(&migration, "name = ?", filename).Error
 	if err != nil {
 
 		if !DBErrorIsRecordNotFound(err) {
@@ -64,8 +231,11 @@ func (m *migrator) saveNewMigrations(ctx context.Context, filename string, migra
 		}
 
 		migration := Migration{
-			Name:  filename,
-			Patch: migrationPatch,
+			Namespace:   m.namespace(),
+			Name:        file.name,
+			Patch:       file.patch,
+			RevertPatch: file.revertPatch,
+			Checksum:    migrationChecksum(file.patch),
 		}
 		err = m.DB(ctx).Create(&migration).Error
 		if err != nil {
@@ -75,11 +245,135 @@ func (m *migrator) saveNewMigrations(ctx context.Context, filename string, migra
 		return nil
 	}
 
-	if !migration.AppliedAt.Valid && migration.Patch != migrationPatch {
-		err := m.DB(ctx).Model(&migration).Update("patch", migrationPatch).Error
+	if !migration.AppliedAt.Valid && migration.Checksum != checksum {
+		err := m.DB(ctx).Model(&migration).Updates(map[string]interface{}{"patch": file.patch, "checksum": checksum}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if migration.AppliedAt.Valid {
+		// Migrations applied before checksums were recorded are vouched for by the patch that was applied
+		if migration.Checksum == "" {
+			migration.Checksum = migrationChecksum(migration.Patch)
+			err := m.DB(ctx).Model(&migration).Update("checksum", migration.Checksum).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		if migration.Checksum != checksum {
+			log.Printf("scanForNewMigrations -- applied migration %s from %s has changed since it was applied", file.name, file.source)
+		}
+	}
+
+	if migration.RevertPatch != file.revertPatch {
+		err := m.DB(ctx).Model(&migration).Update("revert_patch", file.revertPatch).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// claimLegacyMigration moves a migration recorded before namespaces existed into the namespace of the service,
+// provided it was recorded from the same patch so migrations of other services sharing the database are left alone
+func (m *migrator) claimLegacyMigration(ctx context.Context, migration *Migration, name string, checksum string) error {
+
+	err := m.DB(ctx).Model(&Migration{}).
+		Where("COALESCE(namespace, '') = '' AND name = ?", name).First(migration).Error
+	if err != nil {
+		return err
+	}
+
+	if migration.Checksum == "" {
+		migration.Checksum = migrationChecksum(migration.Patch)
+	}
+
+	if migration.Checksum != checksum && migration.AppliedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+
+	migration.Namespace = m.namespace()
+	return m.DB(ctx).Model(migration).Updates(map[string]interface{}{
+		"namespace": migration.Namespace,
+		"checksum":  migration.Checksum,
+	}).Error
+}
+
+// migrationInTransaction reports whether the patch can run within a transaction
+func migrationInTransaction(patch string) bool {
+	for _, line := range strings.Split(patch, "\n") {
+		if strings.TrimSpace(line) == MigrationNoTransactionMarker {
+			return false
+		}
+	}
+	return true
+}
+
+// execute runs the sql patch or the registered go migration function it refers to
+func (m *migrator) execute(ctx context.Context, name string, patch string) error {
+
+	if patch == goMigrationUpPatch || patch == goMigrationDownPatch {
+		fn := m.service.goMigrationFunc(name, patch == goMigrationDownPatch)
+		if fn == nil {
+			return fmt.Errorf("go migration %s is not registered", name)
+		}
+		return fn(ctx)
+	}
+
+	return m.DB(ctx).Exec(patch).Error
+}
+
+// runPatch executes the patch and records the new applied_at of the migration in one transaction
+// unless the patch is marked to run outside of one
+func (m *migrator) runPatch(ctx context.Context, migration *Migration, patch string, appliedAt interface{}) error {
+
+	run := func(ctx context.Context) error {
+		if err := m.execute(ctx, migration.Name, patch); err != nil {
+			return err
+		}
+
+		return m.DB(ctx).Model(migration).Update("applied_at", appliedAt).Error
+	}
+
+	if !migrationInTransaction(patch) {
+		return run(ctx)
+	}
+
+	return m.service.DBTransaction(ctx, run)
+}
+
+func (m *migrator) applyMigration(ctx context.Context, migration *Migration) error {
+
+	err := m.runPatch(ctx, migration, migration.Patch, time.Now())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("applyNewMigrations -- Successfully applied the file : %v", fmt.Sprintf("%s.sql", migration.Name))
+	return nil
+}
+
+// revertMigrations runs the down scripts of the applied migrations in the order supplied and marks them as pending.
+// Nothing is rolled back when any of the migrations lacks a down script.
+func (m *migrator) revertMigrations(ctx context.Context, migrations []*Migration) error {
+
+	for _, migration := range migrations {
+		if strings.TrimSpace(migration.RevertPatch) == "" {
+			return fmt.Errorf("migration %s has no down script and can not be rolled back", migration.Name)
+		}
+	}
+
+	for _, migration := range migrations {
+
+		err := m.runPatch(ctx, migration, migration.RevertPatch, nil)
 		if err != nil {
 			return err
 		}
+
+		log.Printf("revertMigrations -- Successfully rolled back : %s", migration.Name)
 	}
 
 	return nil
@@ -88,7 +382,7 @@ func (m *migrator) saveNewMigrations(ctx context.Context, filename string, migra
 func (m *migrator) applyNewMigrations(ctx context.Context) error {
 
 	var unAppliedMigrations []*Migration
-	err := m.DB(ctx).Where("applied_at IS NULL").Find(&unAppliedMigrations).Error
+	err := m.migrations(ctx).Where("applied_at IS NULL").Order("name").Find(&unAppliedMigrations).Error
 	if err != nil {
 
 		if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -99,29 +393,224 @@ func (m *migrator) applyNewMigrations(ctx context.Context) error {
 	}
 
 	for _, migration := range unAppliedMigrations {
+		if err := m.applyMigration(ctx, migration); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateDown rolls back the last applied migrations of the database resolved for the context
+func (m *migrator) migrateDown(ctx context.Context, steps int) error {
+
+	var appliedMigrations []*Migration
+	err := m.migrations(ctx).Where("applied_at IS NOT NULL").Order("name DESC").Limit(steps).Find(&appliedMigrations).Error
+	if err != nil {
+		return err
+	}
+
+	return m.revertMigrations(ctx, appliedMigrations)
+}
+
+// migrateTo rolls back the migrations applied after the named one and applies the pending ones up to it
+func (m *migrator) migrateTo(ctx context.Context, name string) error {
 
-		if err := m.DB(ctx).Exec(migration.Patch).Error; err != nil {
+	target := Migration{}
+	err := m.migrations(ctx).First(&target, "name = ?", name).Error
+	if err != nil {
+		if DBErrorIsRecordNotFound(err) {
+			return fmt.Errorf("migration %s does not exist", name)
+		}
+		return err
+	}
+
+	var laterMigrations []*Migration
+	err = m.migrations(ctx).Where("applied_at IS NOT NULL AND name > ?", name).Order("name DESC").Find(&laterMigrations).Error
+	if err != nil {
+		return err
+	}
+
+	err = m.revertMigrations(ctx, laterMigrations)
+	if err != nil {
+		return err
+	}
+
+	var pendingMigrations []*Migration
+	err = m.migrations(ctx).Where("applied_at IS NULL AND name <= ?", name).Order("name").Find(&pendingMigrations).Error
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range pendingMigrations {
+		if err := m.applyMigration(ctx, migration); err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
 
-		err := m.DB(ctx).Model(migration).Update("applied_at", time.Now()).Error
+// withMigrationLock runs fn while holding the advisory lock on the service database,
+// so replicas starting together apply the migrations one after the other.
+// The lock belongs to the session so fn runs on the connection holding it, a single connection is enough to migrate.
+func (s *Service) withMigrationLock(ctx context.Context, fn func(ctx context.Context) error) error {
+
+	ctx = withTenantRoute(ctx, "")
+	if s.dbConnection(ctx, false) == nil {
+		return errors.New("no database is setup to migrate")
+	}
+
+	return s.withPinnedConnection(ctx, func(ctx context.Context) error {
+		conn := s.dbConnection(ctx, false)
+
+		err := conn.Exec("SELECT pg_advisory_lock(?)", migrationLockID).Error
 		if err != nil {
 			return err
 		}
 
-		log.Printf("applyNewMigrations -- Successfully applied the file : %v", fmt.Sprintf("%s.sql", migration.Name))
+		defer func() {
+			err := conn.Exec("SELECT pg_advisory_unlock(?)", migrationLockID).Error
+			if err != nil {
+				log.Printf("withMigrationLock -- could not release the migration lock : %s", err)
+			}
+		}()
+
+		return fn(ctx)
+	})
+}
+
+// eachDatastore runs fn against the service database and the datastore of every isolated tenant
+func (s *Service) eachDatastore(ctx context.Context, fn func(ctx context.Context) error) error {
+
+	if s.dataStore.routing == nil {
+		return fn(ctx)
 	}
 
-	return nil
+	err := fn(withTenantRoute(ctx, ""))
+	if err != nil {
+		return err
+	}
+
+	return s.dataStore.routing.eachTenantDatastore(ctx, func(ctx context.Context, _ TenantRoute) error {
+		return fn(ctx)
+	})
+}
+
+// MigrateDown rolls back the last steps applied migrations running their down scripts in reverse order.
+// The down scripts are read from the migrations path, migrations without a down script are never rolled back.
+func (s *Service) MigrateDown(ctx context.Context, migrationsDirPath string, steps int) error {
+
+	if steps < 1 {
+		return fmt.Errorf("can not roll back %d migrations", steps)
+	}
+
+	return s.withMigrationLock(ctx, func(ctx context.Context) error {
+		return s.eachDatastore(ctx, func(ctx context.Context) error {
+			migrationExecutor := migrator{service: s}
+
+			err := migrationExecutor.scanForNewMigrations(ctx, s.resolveMigrationSources(migrationsDirPath))
+			if err != nil {
+				return err
+			}
+
+			return migrationExecutor.migrateDown(ctx, steps)
+		})
+	})
 }
 
-// MigrateDatastore finds missing migrations and records them in the database
+// MigrateTo makes the named migration the last applied one, rolling back the migrations applied after it
+// in reverse order and applying the pending ones that precede it.
+func (s *Service) MigrateTo(ctx context.Context, migrationsDirPath string, name string) error {
+
+	return s.withMigrationLock(ctx, func(ctx context.Context) error {
+		return s.eachDatastore(ctx, func(ctx context.Context) error {
+			migrationExecutor := migrator{service: s}
+
+			err := migrationExecutor.scanForNewMigrations(ctx, s.resolveMigrationSources(migrationsDirPath))
+			if err != nil {
+				return err
+			}
+
+			return migrationExecutor.migrateTo(ctx, name)
+		})
+	})
+}
+
+// Migrate runs the migration command in args, usually the command line arguments following the migrate command.
+// No arguments or up applies the pending migrations, down N rolls back the last N migrations,
+// to NAME moves the database to the named migration and status prints the state of every migration,
+// optionally followed by the namespaces to report on.
+func (s *Service) Migrate(ctx context.Context, migrationsDirPath string, args []string, migrations ...interface{}) error {
+
+	if len(args) > 0 && args[0] == "migrate" {
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		return s.MigrateDatastore(ctx, migrationsDirPath, migrations...)
+	}
+
+	switch args[0] {
+	case "up":
+		return s.MigrateDatastore(ctx, migrationsDirPath, migrations...)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid number of migrations to roll back %s", args[1])
+			}
+		}
+		return s.MigrateDown(ctx, migrationsDirPath, steps)
+	case "status":
+		return s.printMigrationStatus(ctx, migrationsDirPath, os.Stdout, args[1:]...)
+	case "to":
+		if len(args) < 2 {
+			return errors.New("the name of the migration to move to is required")
+		}
+		return s.MigrateTo(ctx, migrationsDirPath, args[1])
+	default:
+		return fmt.Errorf("unknown migration command %s", args[0])
+	}
+}
+
+// MigrateDatastore finds missing migrations and records them in the database.
+// The migrations path is a comma separated list of directories or names of sources registered with WithMigrationSource.
+// When tenant routing is enabled the migrations are also applied to every tenant with a dedicated schema or database.
+// Each migration file is applied in its own transaction while an advisory lock keeps other replicas from migrating concurrently.
 func (s *Service) MigrateDatastore(ctx context.Context, migrationsDirPath string, migrations ...interface{}) error {
-	if migrationsDirPath == "" {
-		migrationsDirPath = "./migrations/0001"
+
+	return s.withMigrationLock(ctx, func(ctx context.Context) error {
+		return s.migrateAllDatastores(ctx, migrationsDirPath, migrations...)
+	})
+}
+
+// migrateAllDatastores migrates the service database and the datastore of every isolated tenant
+func (s *Service) migrateAllDatastores(ctx context.Context, migrationsDirPath string, migrations ...interface{}) error {
+
+	frameModels := []interface{}{&Migration{}, &InboxMessage{}, &ErasureJob{}, &ErasureAudit{}}
+	if s.dataStore.partitions != nil {
+		frameModels = append(frameModels, &Partition{})
+	}
+
+	migrations = append(frameModels, migrations...)
+
+	if s.dataStore.routing == nil {
+		return s.migrateDatastore(ctx, migrationsDirPath, migrations...)
 	}
 
-	migrations = append([]interface{}{&Migration{}}, migrations...)
+	err := s.migrateDatastore(withTenantRoute(ctx, ""), migrationsDirPath, append(migrations, &TenantRoute{})...)
+	if err != nil {
+		return err
+	}
+
+	return s.dataStore.routing.migrateTenantDatastores(ctx, migrationsDirPath, migrations...)
+}
+
+// migrateDatastore applies the models and migration files to the database resolved for the context
+func (s *Service) migrateDatastore(ctx context.Context, migrationsDirPath string, migrations ...interface{}) error {
 	// Migrate the schema
 	err := s.DB(ctx, false).AutoMigrate(migrations...)
 	if err != nil {
@@ -129,13 +618,36 @@ func (s *Service) MigrateDatastore(ctx context.Context, migrationsDirPath string
 		return err
 	}
 
+	// Migration names are unique per namespace, the index predating namespaces made them unique across services
+	if s.DB(ctx, false).Migrator().HasIndex(&Migration{}, "idx_migrations_name") {
+		err = s.DB(ctx, false).Migrator().DropIndex(&Migration{}, "idx_migrations_name")
+		if err != nil {
+			s.L().WithError(err).Error("MigrateDatastore -- couldn't drop the migration name index")
+			return err
+		}
+	}
+
+	err = s.migrateSearchVectors(ctx, migrations...)
+	if err != nil {
+		s.L().WithError(err).Error("MigrateDatastore -- couldn't create search vectors")
+		return err
+	}
+
 	migrationExecutor := migrator{service: s}
+	sources := s.resolveMigrationSources(migrationsDirPath)
 
-	if err := migrationExecutor.scanForNewMigrations(ctx, migrationsDirPath); err != nil {
+	if err := migrationExecutor.scanForNewMigrations(ctx, sources); err != nil {
 		log.Printf("MigrateDatastore -- Error scanning for new migrations : %s ", err)
 		return err
 	}
 
+	if s.dataStore.failOnMigrationDrift {
+		if err := migrationExecutor.checkDrift(ctx, sources); err != nil {
+			log.Printf("MigrateDatastore -- %s ", err)
+			return err
+		}
+	}
+
 	if err := migrationExecutor.applyNewMigrations(ctx); err != nil {
 		log.Printf("MigrateDatastore -- There was an error applying migrations : %s ", err)
 		return err
@@ -0,0 +1,149 @@
+package frame
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const partitionHierarchyDefaultTTL = 5 * time.Minute
+
+// Partition links a partition to its parent within a tenant, partitions without a parent are roots of the hierarchy
+type Partition struct {
+	ID         string `gorm:"type:varchar(50);primary_key"`
+	TenantID   string `gorm:"type:varchar(50);index"`
+	ParentID   string `gorm:"type:varchar(50);index"`
+	CreatedAt  time.Time
+	ModifiedAt time.Time
+}
+
+// PartitionHierarchyLoader returns the parent of every partition of a tenant keyed by the partition id
+type PartitionHierarchyLoader func(ctx context.Context, tenantID string) (map[string]string, error)
+
+type partitionTree struct {
+	children map[string][]string
+	loadedAt time.Time
+}
+
+type partitionHierarchy struct {
+	ttl    time.Duration
+	loader PartitionHierarchyLoader
+	cache  sync.Map
+}
+
+// WithPartitionHierarchy Option that enables nested partitions.
+// Claims that grant access to a partition subtree are then able to reach data of every descendant partition.
+// The hierarchy of each tenant is cached in process and reloaded after the ttl, which is 5 minutes by default.
+// When loader is nil the hierarchy is read from the Partition table.
+func WithPartitionHierarchy(ttl time.Duration, loader PartitionHierarchyLoader) Option {
+	return func(s *Service) {
+		if ttl <= 0 {
+			ttl = partitionHierarchyDefaultTTL
+		}
+
+		if loader == nil {
+			loader = s.loadPartitionHierarchy
+		}
+
+		s.dataStore.partitions = &partitionHierarchy{
+			ttl:    ttl,
+			loader: loader,
+		}
+	}
+}
+
+// loadPartitionHierarchy reads the parents of all partitions of a tenant from the Partition table
+func (s *Service) loadPartitionHierarchy(ctx context.Context, tenantID string) (map[string]string, error) {
+	var partitions []Partition
+	err := s.DB(AsSystem(ctx), true).Where("tenant_id = ?", tenantID).Find(&partitions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make(map[string]string, len(partitions))
+	for _, partition := range partitions {
+		parents[partition.ID] = partition.ParentID
+	}
+	return parents, nil
+}
+
+// InvalidatePartitionHierarchy drops the cached hierarchy of a tenant so that it is reloaded on next use
+func (s *Service) InvalidatePartitionHierarchy(tenantID string) {
+	if s.dataStore.partitions != nil {
+		s.dataStore.partitions.cache.Delete(tenantID)
+	}
+}
+
+// AccessiblePartitions lists the partitions the authentication claims in the context can reach
+func (s *Service) AccessiblePartitions(ctx context.Context) []string {
+	authClaim := ClaimsFromContext(ctx)
+	if authClaim == nil || authClaim.PartitionID == "" {
+		return nil
+	}
+	return s.dataStore.accessiblePartitions(ctx, authClaim)
+}
+
+// accessiblePartitions returns the partition of the claims along with its descendants when a subtree is granted.
+// If the hierarchy can not be loaded access is limited to the partition of the claims.
+func (st *store) accessiblePartitions(ctx context.Context, authClaim *AuthenticationClaims) []string {
+	if st == nil || st.partitions == nil || !authClaim.PartitionSubtree {
+		return []string{authClaim.PartitionID}
+	}
+
+	tree, err := st.partitions.tree(ctx, authClaim.TenantID)
+	if err != nil {
+		service := FromContext(ctx)
+		if service != nil {
+			service.L().WithError(err).WithField("tenant", authClaim.TenantID).
+				Warn("could not load partition hierarchy")
+		}
+		return []string{authClaim.PartitionID}
+	}
+
+	return tree.descendants(authClaim.PartitionID)
+}
+
+// tree returns the cached hierarchy of a tenant loading it when missing or stale
+func (ph *partitionHierarchy) tree(ctx context.Context, tenantID string) (*partitionTree, error) {
+	if cached, ok := ph.cache.Load(tenantID); ok {
+		tree := cached.(*partitionTree)
+		if time.Since(tree.loadedAt) < ph.ttl {
+			return tree, nil
+		}
+	}
+
+	parents, err := ph.loader(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &partitionTree{
+		children: make(map[string][]string),
+		loadedAt: time.Now(),
+	}
+	for partitionID, parentID := range parents {
+		if parentID != "" {
+			tree.children[parentID] = append(tree.children[parentID], partitionID)
+		}
+	}
+
+	ph.cache.Store(tenantID, tree)
+	return tree, nil
+}
+
+// descendants lists a partition and all partitions below it
+func (pt *partitionTree) descendants(partitionID string) []string {
+	visited := map[string]bool{partitionID: true}
+	result := []string{partitionID}
+
+	for i := 0; i < len(result); i++ {
+		for _, child := range pt.children[result[i]] {
+			if !visited[child] {
+				visited[child] = true
+				result = append(result, child)
+			}
+		}
+	}
+
+	return result
+}
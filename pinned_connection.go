@@ -0,0 +1,134 @@
+package frame
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/gorm"
+)
+
+const ctxKeyPinnedConnection = contextKey("pinnedConnectionKey")
+
+// pinnedConnPool is a single connection of a datastore that every statement of a unit of work runs on.
+// Settings are applied for its session, so statements that can not run within a transaction are supported.
+type pinnedConnPool struct {
+	*sql.Conn
+	db *sql.DB
+	// searchPath is the search_path the connection had when it was pinned, restored for the service database
+	searchPath string
+}
+
+func (p *pinnedConnPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	tx, err := p.Conn.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &hookedTx{Tx: tx, db: p.db, pinned: p}, nil
+}
+
+func (p *pinnedConnPool) GetDBConn() (*sql.DB, error) {
+	return p.db, nil
+}
+
+// pinnedConnection links the connections pinned for a context, one per database
+type pinnedConnection struct {
+	db     *gorm.DB
+	pool   *pinnedConnPool
+	parent *pinnedConnection
+}
+
+// pinnedConnectionFor returns the connection pinned in the context for the database db belongs to
+func pinnedConnectionFor(ctx context.Context, db *gorm.DB) *gorm.DB {
+	pinned, ok := ctx.Value(ctxKeyPinnedConnection).(*pinnedConnection)
+	if !ok || db.Error != nil {
+		return nil
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil
+	}
+
+	for ; pinned != nil; pinned = pinned.parent {
+		if pinned.pool.db == sqlDB {
+			return pinned.db
+		}
+	}
+	return nil
+}
+
+// statementPinnedPool returns the pinned connection the statement runs on, within a transaction or not
+func statementPinnedPool(db *gorm.DB) *pinnedConnPool {
+	switch pool := db.Statement.ConnPool.(type) {
+	case *pinnedConnPool:
+		return pool
+	case *hookedTx:
+		return pool.pinned
+	}
+	return nil
+}
+
+// withPinnedConnection runs fn with a context whose statements against the database resolved for it
+// all run on one connection, a connection already pinned for that database is reused.
+func (s *Service) withPinnedConnection(ctx context.Context, fn func(ctx context.Context) error) error {
+
+	db := s.dbConnection(ctx, false)
+	if db == nil {
+		return errors.New("no database is setup")
+	}
+	if db.Error != nil {
+		return db.Error
+	}
+
+	if _, ok := db.Statement.ConnPool.(*pinnedConnPool); ok {
+		return fn(ctx)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.dataStore.pinConnection(ctx, sqlDB)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	pool := &pinnedConnPool{Conn: conn, db: sqlDB}
+	err = conn.QueryRowContext(ctx, "SHOW search_path").Scan(&pool.searchPath)
+	if err != nil {
+		return err
+	}
+
+	pinnedDB := db.Session(&gorm.Session{NewDB: true, Context: ctx})
+	pinnedDB.Statement.ConnPool = pool
+
+	parent, _ := ctx.Value(ctxKeyPinnedConnection).(*pinnedConnection)
+	return fn(context.WithValue(ctx, ctxKeyPinnedConnection, &pinnedConnection{db: pinnedDB, pool: pool, parent: parent}))
+}
+
+// pinConnection takes a connection out of the pool recording that resetSession has to clear its settings
+func (st *store) pinConnection(ctx context.Context, sqlDB *sql.DB) (*sql.Conn, error) {
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.Raw(func(driverConn any) error {
+		pgxConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return errors.New("session settings require the pgx driver")
+		}
+		st.markSessionConfigured(pgxConn.Conn())
+		return nil
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -5,13 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/alitto/pond"
 	_ "github.com/pitabwire/natspubsub"
+	"github.com/rs/xid"
 	"github.com/sirupsen/logrus"
 	"gocloud.dev/pubsub"
 	_ "gocloud.dev/pubsub/mempubsub"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type queue struct {
@@ -53,10 +56,24 @@ type subscriber struct {
 	url          string
 	concurrency  int
 	handler      SubscribeWorker
-	subscription *pubsub.Subscription
+	subscription atomic.Pointer[pubsub.Subscription]
 	isInit       atomic.Bool
+	inbox        *inbox
+	deadLetter   *deadLetter
+	retry        *RetryPolicy
+	inFlight     chan struct{}
+	held         chan struct{}
+	dedicated    bool
+	pool         *pond.WorkerPool
+
+	reconnectPolicy *RetryPolicy
+	state           atomic.Value
+	failures        int
 }
 
+// SubscriberOption configures optional behaviour of a subscriber registered with RegisterSubscriber
+type SubscriberOption func(s *subscriber)
+
 func (s *subscriber) listen(ctx context.Context) {
 
 	service := FromContext(ctx)
@@ -72,50 +89,82 @@ func (s *subscriber) listen(ctx context.Context) {
 
 		default:
 
-			msg, err := s.subscription.Receive(ctx)
+			// Stop pulling messages while the subscriber is busy with as many as its concurrency allows
+			if !s.acquire(ctx) {
+				continue
+			}
+
+			msg, err := s.subscription.Load().Receive(ctx)
 			if err != nil {
-				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				s.release()
+				if ctx.Err() != nil {
 					continue
 				}
 
-				logger.WithError(err).Error(" could not pull message")
-				s.isInit.Store(false)
-				service.errorChannel <- err
-				return
+				logger.WithError(err).Warn(" could not pull message")
+				err = s.reconnect(ctx, service, logger, err)
+				if err != nil {
+					logger.WithError(err).Error(" subscription failure budget exhausted")
+					s.isInit.Store(false)
+					service.sendStopError(ctx, err)
+					return
+				}
+				continue
 			}
+			s.failures = 0
 
-			job := service.NewJob(func(ctx context.Context) error {
-				authClaim := ClaimsFromMap(msg.Metadata)
+			// Requeued messages wait for their not before timestamp without holding an in flight slot
+			if delay := untilDue(msg.Metadata); delay > 0 {
+				s.release()
+				s.holdUntilDue(ctx, service, logger, msg, delay)
+				continue
+			}
 
-				var ctx2 context.Context
-				if nil != authClaim {
-					ctx2 = authClaim.ClaimsToContext(ctx)
-				} else {
-					ctx2 = ctx
-				}
+			s.dispatch(ctx, service, logger, msg)
+		}
+	}
+}
 
-				err0 := s.handler.Handle(ctx2, msg.Metadata, msg.Body)
-				if err0 != nil {
-					logger.WithError(err0).Warn(" could not handle message")
-					if msg.Nackable() {
-						msg.Nack()
-					}
-					return err0
-				}
-				msg.Ack()
-				return nil
-			})
+// dispatch submits the job handling a message that holds an in flight slot, the slot is released once it is done
+func (s *subscriber) dispatch(ctx context.Context, service *Service, logger *logrus.Entry, msg *pubsub.Message) {
 
-			err = service.SubmitJob(ctx, job)
-			if err != nil {
-				logger.WithError(err).Warn(" Ignoring handle error message")
-				continue
-			}
+	job := service.NewJob(func(ctx context.Context) error {
+		defer s.release()
 
+		err := s.handleWithRetries(ctx, msg)
+		if err != nil {
+			logger.WithError(err).Warn(" could not handle message")
+			s.handleFailure(ctx, msg, err)
+			return err
 		}
+		msg.Ack()
+		return nil
+	})
+
+	err := s.submit(ctx, service, job)
+	if err != nil {
+		s.release()
+		logger.WithError(err).Warn(" Ignoring handle error message")
 	}
 }
 
+// handle runs the handler for the message on behalf of the claims in its metadata
+func (s *subscriber) handle(ctx context.Context, msg *pubsub.Message) error {
+	authClaim := ClaimsFromMap(msg.Metadata)
+
+	if nil != authClaim {
+		ctx = authClaim.ClaimsToContext(ctx)
+	}
+
+	if s.inbox != nil {
+		return s.inbox.process(ctx, s.reference, msg, func(ctx context.Context) error {
+			return s.handler.Handle(ctx, msg.Metadata, msg.Body)
+		})
+	}
+
+	return s.handler.Handle(ctx, msg.Metadata, msg.Body)
+}
+
 // RegisterPublisher Option to register publishing path referenced within the system
 func RegisterPublisher(reference string, queueURL string) Option {
 	return func(s *Service) {
@@ -126,16 +175,34 @@ func RegisterPublisher(reference string, queueURL string) Option {
 	}
 }
 
-// RegisterSubscriber Option to register a new subscription handler
+// RegisterSubscriber Option to register a new subscription handler.
+// At most concurrency messages are handled at a time, the subscriber stops receiving until one of them is done.
 func RegisterSubscriber(reference string, queueURL string, concurrency int,
-	handler SubscribeWorker) Option {
+	handler SubscribeWorker, opts ...SubscriberOption) Option {
 	return func(s *Service) {
-		s.queue.subscriptionQueueMap.Store(reference, &subscriber{
+		subs := &subscriber{
 			reference:   reference,
 			url:         queueURL,
 			concurrency: concurrency,
 			handler:     handler,
-		})
+		}
+
+		for _, opt := range opts {
+			opt(subs)
+		}
+
+		if subs.concurrency < 1 {
+			subs.concurrency = 1
+		}
+		subs.inFlight = make(chan struct{}, subs.concurrency)
+		subs.held = make(chan struct{}, subs.concurrency)
+
+		if subs.reconnectPolicy == nil {
+			policy := DefaultReconnectPolicy()
+			subs.reconnectPolicy = &policy
+		}
+
+		s.queue.subscriptionQueueMap.Store(reference, subs)
 	}
 }
 
@@ -158,6 +225,31 @@ func (s *Service) Publish(ctx context.Context, reference string, payload interfa
 		metadata = make(map[string]string)
 	}
 
+	if messageID := messageIDFromContext(ctx); messageID != "" {
+		metadata[inboxMessageIDKey] = messageID
+	} else if metadata[inboxMessageIDKey] == "" {
+		metadata[inboxMessageIDKey] = xid.New().String()
+	}
+
+	var message []byte
+	msg, ok := payload.([]byte)
+	if !ok {
+		msg0, err0 := json.Marshal(payload)
+		if err0 != nil {
+			return err0
+		}
+		message = msg0
+	} else {
+		message = msg
+	}
+
+	return s.publishMessage(ctx, reference, message, metadata)
+}
+
+// publishMessage sends the message as is to the publisher with the reference,
+// references that are queue urls get a publisher opened on first use
+func (s *Service) publishMessage(ctx context.Context, reference string, message []byte, metadata map[string]string) error {
+
 	pub, err := s.queue.getPublisherByReference(reference)
 	if err != nil {
 		if err.Error() != "reference does not exist" {
@@ -179,25 +271,12 @@ func (s *Service) Publish(ctx context.Context, reference string, payload interfa
 		s.queue.publishQueueMap.Store(reference, pub)
 	}
 
-	var message []byte
-	msg, ok := payload.([]byte)
-	if !ok {
-		msg0, err0 := json.Marshal(payload)
-		if err0 != nil {
-			return err
-		}
-		message = msg0
-	} else {
-		message = msg
-	}
-
 	topic := pub.topic
 
 	return topic.Send(ctx, &pubsub.Message{
 		Body:     message,
 		Metadata: metadata,
 	})
-
 }
 
 func (s *Service) initPublisher(ctx context.Context, pub *publisher) error {
@@ -223,19 +302,43 @@ func (s *Service) initSubscriber(ctx context.Context, sub *subscriber) error {
 	s.stopMutex.Lock()
 	defer s.stopMutex.Unlock()
 
-	if sub.isInit.Load() && sub.subscription != nil {
+	if sub.isInit.Load() && sub.subscription.Load() != nil {
 		return nil
 	}
 
+	if err := sub.checkRequeue(); err != nil {
+		return err
+	}
+
 	if !strings.HasPrefix(sub.url, "http") {
 
 		subsc, err := pubsub.OpenSubscription(ctx, sub.url)
 		if err != nil {
 			return fmt.Errorf("could not open topic subscription: %s", err)
 		}
-		sub.subscription = subsc
+		sub.subscription.Store(subsc)
 	}
 	sub.isInit.Store(true)
+	sub.setState(SubscriptionActive)
+	return nil
+}
+
+// reopenSubscriber replaces the failed subscription of the subscriber with a new one,
+// messages of the old subscription acknowledged after it is shut down are redelivered
+func (s *Service) reopenSubscriber(ctx context.Context, sub *subscriber) error {
+
+	if failed := sub.subscription.Load(); failed != nil {
+		shutdownCtx, cancel := context.WithTimeout(ctx, time.Second)
+		_ = failed.Shutdown(shutdownCtx)
+		cancel()
+	}
+
+	subsc, err := pubsub.OpenSubscription(ctx, sub.url)
+	if err != nil {
+		return fmt.Errorf("could not open topic subscription: %s", err)
+	}
+
+	sub.subscription.Store(subsc)
 	return nil
 }
 
@@ -309,8 +412,22 @@ func (s *Service) subscribe(ctx context.Context) {
 		}
 		subsc.logger = logger
 
+		if subsc.dedicated && subsc.pool == nil {
+			pool := pond.New(subsc.concurrency, subsc.concurrency, pond.Strategy(pond.Lazy()))
+			subsc.pool = pool
+			s.AddCleanupMethod(func(ctx context.Context) {
+				pool.StopAndWait()
+			})
+		}
+
+		s.AddHealthCheck(subsc)
+
 		go subsc.listen(ctx)
 
+		if subsc.inbox != nil {
+			go subsc.inbox.sweep(ctx, subsc.reference)
+		}
+
 		return true
 	})
 }
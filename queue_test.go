@@ -7,6 +7,7 @@ import (
 	"github.com/pitabwire/frame"
 	"log"
 	"testing"
+	"time"
 )
 
 func TestService_RegisterPublisherNotSet(t *testing.T) {
@@ -198,3 +199,54 @@ func TestService_RegisterSubscriberContextCancelWorks(t *testing.T) {
 	srv.Stop(ctx)
 
 }
+
+type metadataRecorder struct {
+	received chan map[string]string
+}
+
+func (h *metadataRecorder) Handle(ctx context.Context, metadata map[string]string, message []byte) error {
+	h.received <- metadata
+	return nil
+}
+
+func TestService_PublishKeepsMessageID(t *testing.T) {
+	recorder := &metadataRecorder{received: make(chan map[string]string, 2)}
+
+	ctx, srv := frame.NewService("Test Srv", frame.NoopDriver(),
+		frame.RegisterPublisher("identified", "mem://identifiedWork"),
+		frame.RegisterSubscriber("identified", "mem://identifiedWork", 1, recorder))
+
+	err := srv.Run(ctx, "")
+	if err != nil {
+		t.Errorf("We couldn't instantiate queue  %s", err)
+		return
+	}
+	defer srv.Stop(ctx)
+
+	err = srv.Publish(frame.WithMessageID(ctx, "order-42"), "identified", []byte("resent"))
+	if err != nil {
+		t.Errorf("We could not publish to topic that was registered %s", err)
+		return
+	}
+
+	err = srv.Publish(ctx, "identified", []byte("fresh"))
+	if err != nil {
+		t.Errorf("We could not publish to topic that was registered %s", err)
+		return
+	}
+
+	messageIDs := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case metadata := <-recorder.received:
+			messageIDs[metadata["message_id"]] = true
+		case <-time.After(5 * time.Second):
+			t.Errorf("Published messages were not received")
+			return
+		}
+	}
+
+	if !messageIDs["order-42"] || len(messageIDs) != 2 {
+		t.Errorf("Expected the supplied message id and a generated one but got %v", messageIDs)
+	}
+}
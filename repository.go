@@ -1,11 +1,18 @@
 package frame
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
+	"reflect"
+	"strings"
+	"time"
 )
 
+const defaultRepositoryBatchSize = 100
+
 type BaseRepositoryI interface {
 	GetByID(id string, result BaseModelI) error
 	Delete(id string) error
@@ -16,14 +23,44 @@ type BaseRepository struct {
 	readDb          *gorm.DB
 	writeDb         *gorm.DB
 	instanceCreator func() BaseModelI
+	batchSize       int
+	cache           *entityCache
+}
+
+// RepositoryOption configures optional behaviour of a BaseRepository
+type RepositoryOption func(repo *BaseRepository)
+
+// WithBatchSize RepositoryOption sets how many rows the bulk operations write per statement, 100 by default
+func WithBatchSize(size int) RepositoryOption {
+	return func(repo *BaseRepository) {
+		if size > 0 {
+			repo.batchSize = size
+		}
+	}
+}
+
+// WithCache RepositoryOption serves GetByID from the entity cache of the service, see WithEntityCache.
+// Entries are keyed by tenant, table and id and dropped whenever the repository changes the entity.
+// Models owned by access ids are never cached.
+func WithCache(service *Service) RepositoryOption {
+	return func(repo *BaseRepository) {
+		repo.cache = service.dataStore.cache
+	}
 }
 
-func NewBaseRepository(readDb *gorm.DB, writeDB *gorm.DB, instanceCreator func() BaseModelI) *BaseRepository {
-	return &BaseRepository{
+func NewBaseRepository(readDb *gorm.DB, writeDB *gorm.DB, instanceCreator func() BaseModelI, opts ...RepositoryOption) *BaseRepository {
+	repo := &BaseRepository{
 		readDb:          readDb,
 		writeDb:         writeDB,
 		instanceCreator: instanceCreator,
+		batchSize:       defaultRepositoryBatchSize,
 	}
+
+	for _, opt := range opts {
+		opt(repo)
+	}
+
+	return repo
 }
 
 func (repo *BaseRepository) getReadDb() *gorm.DB {
@@ -34,6 +71,85 @@ func (repo *BaseRepository) getWriteDb() *gorm.DB {
 	return repo.writeDb
 }
 
+// cacheSchema returns the schema of the repository's model when its entities can be cached
+func (repo *BaseRepository) cacheSchema() (*gorm.Statement, bool) {
+	if repo.cache == nil {
+		return nil, false
+	}
+
+	instance := repo.instanceCreator()
+	if owned, ok := instance.(AccessOwnedModel); ok && owned.AccessOwned() {
+		return nil, false
+	}
+
+	stmt := &gorm.Statement{DB: repo.getReadDb().Session(&gorm.Session{})}
+	if err := stmt.Parse(instance); err != nil {
+		return nil, false
+	}
+
+	// Cached entities are decrypted, encrypted columns would be kept in plaintext by the cache backend
+	for _, field := range stmt.Schema.Fields {
+		if strings.EqualFold(field.TagSettings["SERIALIZER"], EncryptedSerializer) {
+			return nil, false
+		}
+	}
+	return stmt, true
+}
+
+// cacheKeys lists the keys an entity may be cached under, within its tenant and for lookups made without claims
+func (repo *BaseRepository) cacheKeys(tenantID string, ids ...string) []string {
+	stmt, ok := repo.cacheSchema()
+	if !ok {
+		return nil
+	}
+
+	return repo.cache.entityKeys(tenantID, stmt.Table, ids...)
+}
+
+// invalidateAfterCommit drops the cached entities under the keys once the transaction db takes part in commits,
+// readers filling the cache in the meantime would otherwise cache the rows as they were before the transaction
+func (repo *BaseRepository) invalidateAfterCommit(db *gorm.DB, keys []string) {
+	if repo.cache == nil || len(keys) == 0 {
+		return
+	}
+
+	ctx := db.Statement.Context
+	afterCommit(db, func() {
+		repo.cache.invalidate(ctx, keys...)
+	})
+}
+
+// invalidateInstances drops the cached copies of the supplied instance or slice of instances
+func (repo *BaseRepository) invalidateInstances(db *gorm.DB, instances interface{}) {
+	ctx := db.Statement.Context
+	stmt, ok := repo.cacheSchema()
+	if !ok {
+		return
+	}
+
+	tenantField := stmt.Schema.LookUpField("tenant_id")
+
+	var keys []string
+	_ = walkReflectValue(reflect.Indirect(reflect.ValueOf(instances)), func(value reflect.Value) error {
+		tenantID := ""
+		if tenantField != nil {
+			tenant, _ := tenantField.ValueOf(ctx, value)
+			tenantID, _ = tenant.(string)
+		}
+
+		if !value.CanAddr() {
+			return nil
+		}
+
+		if instance, ok := value.Addr().Interface().(BaseModelI); ok {
+			keys = append(keys, repo.cacheKeys(tenantID, instance.GetID())...)
+		}
+		return nil
+	})
+
+	repo.invalidateAfterCommit(db, keys)
+}
+
 func (repo *BaseRepository) Delete(id string) error {
 	deleteInstance := repo.instanceCreator()
 	err := repo.GetByID(id, deleteInstance)
@@ -41,12 +157,58 @@ func (repo *BaseRepository) Delete(id string) error {
 		return err
 	}
 
-	return repo.getWriteDb().Delete(deleteInstance).Error
+	err = repo.getWriteDb().Delete(deleteInstance).Error
+	if err != nil {
+		return err
+	}
 
+	repo.invalidateInstances(repo.getWriteDb(), deleteInstance)
+	return nil
 }
 
 func (repo *BaseRepository) GetByID(id string, result BaseModelI) error {
-	return repo.getReadDb().Preload(clause.Associations).First(result, "id = ?", id).Error
+
+	stmt, cacheable := repo.cacheSchema()
+	if !cacheable {
+		return repo.getReadDb().Preload(clause.Associations).First(result, "id = ?", id).Error
+	}
+
+	ctx := repo.getReadDb().Statement.Context
+
+	tenantID := ""
+	authClaim := tenantClaims(ctx)
+	if authClaim != nil {
+		tenantID = authClaim.TenantID
+	}
+
+	key := repo.cache.key(tenantID, stmt.Table, id)
+	if repo.cache.get(ctx, key, result) && repo.cachedEntityReachable(ctx, stmt, authClaim, result) {
+		return nil
+	}
+
+	err := repo.getReadDb().Preload(clause.Associations).First(result, "id = ?", id).Error
+	if err != nil {
+		return err
+	}
+
+	repo.cache.set(ctx, key, result)
+	return nil
+}
+
+// cachedEntityReachable confirms that an entity cached for the tenant belongs to a partition the claims can reach
+func (repo *BaseRepository) cachedEntityReachable(ctx context.Context, stmt *gorm.Statement,
+	authClaim *AuthenticationClaims, result BaseModelI) bool {
+	if authClaim == nil {
+		return true
+	}
+
+	partitionField := stmt.Schema.LookUpField("partition_id")
+	if partitionField == nil {
+		return true
+	}
+
+	partition, _ := partitionField.ValueOf(ctx, reflect.Indirect(reflect.ValueOf(result)))
+	return containsValue(repo.cache.service.dataStore.accessiblePartitions(ctx, authClaim), partition)
 }
 
 func (repo *BaseRepository) GetLastestBy(properties map[string]interface{}, result BaseModelI) error {
@@ -95,7 +257,200 @@ func (repo *BaseRepository) Save(instance BaseModelI) error {
 			return err
 		}
 	} else {
-		return repo.getWriteDb().Save(instance).Error
+		err := repo.getWriteDb().Save(instance).Error
+		if err != nil {
+			return err
+		}
+
+		repo.invalidateInstances(repo.getWriteDb(), instance)
 	}
 	return nil
 }
+
+// CreateMany inserts a slice of new instances in batches within a single transaction.
+// The BaseModel hooks fill in the ids, timestamps, versions and tenant fields of every instance.
+func (repo *BaseRepository) CreateMany(instances interface{}) error {
+	return repo.getWriteDb().Session(&gorm.Session{}).Transaction(func(tx *gorm.DB) error {
+		return tx.CreateInBatches(instances, repo.batchSize).Error
+	})
+}
+
+// Upsert inserts a slice of instances in batches updating the rows that conflict on the supplied columns.
+// The conflicting rows get the updateColumns of the instance, all columns except the id, creation and deletion
+// times, tenant and access fields when none are supplied, and have their modification time and version bumped.
+// Conflicting rows belonging to another tenant, partition or access owner are left untouched.
+func (repo *BaseRepository) Upsert(instances interface{}, conflictColumns []string, updateColumns ...string) error {
+
+	db := repo.getWriteDb().Session(&gorm.Session{})
+
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(repo.instanceCreator()); err != nil {
+		return err
+	}
+
+	if len(updateColumns) == 0 {
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !field.PrimaryKey && field.DBName != "deleted_at" {
+				updateColumns = append(updateColumns, field.DBName)
+			}
+		}
+	}
+
+	onConflict := clause.OnConflict{}
+	for _, column := range conflictColumns {
+		onConflict.Columns = append(onConflict.Columns, clause.Column{Name: column})
+	}
+
+	for _, column := range updateColumns {
+		if _, ok := immutableColumns[column]; ok {
+			continue
+		}
+		onConflict.DoUpdates = append(onConflict.DoUpdates, clause.AssignmentColumns([]string{column})...)
+	}
+
+	if len(onConflict.DoUpdates) != 0 {
+		onConflict.DoUpdates = append(onConflict.DoUpdates, changeAssignments(stmt)...)
+	}
+
+	if len(onConflict.DoUpdates) == 0 {
+		onConflict.DoNothing = true
+	}
+
+	// The instances keep the ids generated for them, conflicting rows are invalidated by the ids they already had
+	return db.Transaction(func(tx *gorm.DB) error {
+		tx, affected := captureAffectedRows(tx)
+		err := tx.Clauses(onConflict).CreateInBatches(instances, repo.batchSize).Error
+		if err != nil {
+			return err
+		}
+
+		var keys []string
+		for _, row := range affected.list() {
+			if !row.Created {
+				keys = append(keys, repo.cacheKeys(row.TenantID, row.ID)...)
+			}
+		}
+		repo.invalidateAfterCommit(tx, keys)
+		return nil
+	})
+}
+
+// immutableColumns are never overwritten by bulk updates, the change tracking columns are bumped by changeAssignments
+var immutableColumns = map[string]struct{}{
+	"id": {}, "created_at": {}, "modified_at": {}, "version": {}, "tenant_id": {}, "partition_id": {}, "access_id": {},
+}
+
+// changeAssignments refreshes the modification time and increments the version of every row a bulk update touches
+func changeAssignments(stmt *gorm.Statement) []clause.Assignment {
+	var assignments []clause.Assignment
+	if stmt.Schema.LookUpField("modified_at") != nil {
+		assignments = append(assignments, clause.Assignment{Column: clause.Column{Name: "modified_at"}, Value: time.Now()})
+	}
+	if stmt.Schema.LookUpField("version") != nil {
+		assignments = append(assignments, clause.Assignment{
+			Column: clause.Column{Name: "version"},
+			Value:  clause.Expr{SQL: "?.? + 1", Vars: []interface{}{clause.Table{Name: stmt.Table}, clause.Column{Name: "version"}}},
+		})
+	}
+	return assignments
+}
+
+// batchIDs walks the ids of the rows matching the conditions in batches, handing each batch to the supplied function
+func (repo *BaseRepository) batchIDs(conditions map[string]interface{}, fn func(tx *gorm.DB, ids []string) (int64, error)) (int64, error) {
+
+	if len(conditions) == 0 {
+		return 0, errors.New("bulk operations require at least one condition")
+	}
+
+	var total int64
+	lastID := ""
+
+	columns := []string{"id"}
+	if stmt, ok := repo.cacheSchema(); ok && stmt.Schema.LookUpField("tenant_id") != nil {
+		columns = append(columns, "tenant_id")
+	}
+
+	for {
+		var rows []map[string]interface{}
+		err := repo.getWriteDb().Session(&gorm.Session{}).
+			Model(repo.instanceCreator()).Select(columns).
+			Where(conditions).Where("id > ?", lastID).
+			Order("id").Limit(repo.batchSize).
+			Find(&rows).Error
+		if err != nil {
+			return total, err
+		}
+
+		if len(rows) == 0 {
+			return total, nil
+		}
+
+		ids := make([]string, 0, len(rows))
+		var cacheKeys []string
+		for _, row := range rows {
+			id := fmt.Sprint(row["id"])
+			tenantID, _ := row["tenant_id"].(string)
+			ids = append(ids, id)
+			cacheKeys = append(cacheKeys, repo.cacheKeys(tenantID, id)...)
+		}
+
+		var affected int64
+		err = repo.getWriteDb().Session(&gorm.Session{}).Transaction(func(tx *gorm.DB) error {
+			var err error
+			affected, err = fn(tx, ids)
+			if err != nil {
+				return err
+			}
+
+			repo.invalidateAfterCommit(tx, cacheKeys)
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+
+		total += affected
+		lastID = ids[len(ids)-1]
+
+		if len(ids) < repo.batchSize {
+			return total, nil
+		}
+	}
+}
+
+// UpdateWhere applies the updates to every row matching the conditions, a batch of rows per transaction.
+// The modification time is refreshed and the version incremented for every updated row.
+// The number of rows updated is returned.
+func (repo *BaseRepository) UpdateWhere(conditions map[string]interface{}, updates map[string]interface{}) (int64, error) {
+
+	return repo.batchIDs(conditions, func(tx *gorm.DB, ids []string) (int64, error) {
+
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(repo.instanceCreator()); err != nil {
+			return 0, err
+		}
+
+		assignments := map[string]interface{}{}
+		for key, value := range updates {
+			assignments[key] = value
+		}
+		for _, assignment := range changeAssignments(stmt) {
+			assignments[assignment.Column.Name] = assignment.Value
+		}
+
+		// The model hooks would assign an id to the placeholder instance and restrict the update to it
+		result := tx.Session(&gorm.Session{SkipHooks: true}).
+			Model(repo.instanceCreator()).Where("id IN ?", ids).Updates(assignments)
+		return result.RowsAffected, result.Error
+	})
+}
+
+// DeleteWhere deletes every row matching the conditions, a batch of rows per transaction.
+// The number of rows deleted is returned.
+func (repo *BaseRepository) DeleteWhere(conditions map[string]interface{}) (int64, error) {
+
+	return repo.batchIDs(conditions, func(tx *gorm.DB, ids []string) (int64, error) {
+		result := tx.Delete(repo.instanceCreator(), "id IN ?", ids)
+		return result.RowsAffected, result.Error
+	})
+}
@@ -0,0 +1,227 @@
+package frame
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"gocloud.dev/pubsub"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// NotBeforeKey is the metadata key holding the time before which a requeued message is not handled
+const NotBeforeKey = "not_before"
+
+// ErrNonRetryable marks handler errors that no further attempt can fix, wrap it to skip the remaining attempts
+var ErrNonRetryable = errors.New("non retryable")
+
+// RetryPolicy controls how a subscriber retries the messages its handler fails.
+// The delay before attempt n+1 is InitialBackoff * Multiplier^(n-1) capped at MaxBackoff,
+// reduced by up to the Jitter fraction at random so that failed messages do not come back together.
+// Retryable classifies errors, by default every error not wrapping ErrNonRetryable is retried.
+// Messages are requeued carrying a not before timestamp that the subscriber waits for,
+// with HoldMessage the subscriber instead keeps the message unacknowledged and retries it in process,
+// which suits drivers that can not publish back to the subscription.
+// MaxHold bounds how long a message is kept unacknowledged either way, keep it below the ack deadline of the subscription
+// or the broker delivers the message again while it is held.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+	Retryable      func(err error) bool
+	HoldMessage    bool
+	MaxHold        time.Duration
+}
+
+// DefaultRetryPolicy makes 5 attempts starting with a one second delay doubling up to five minutes,
+// messages are held for at most ten seconds
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Minute,
+		Multiplier:     2,
+		Jitter:         0.2,
+		MaxHold:        10 * time.Second,
+	}
+}
+
+// WithRetryPolicy SubscriberOption retries failed messages with the backoff of the policy,
+// combine it with WithDeadLetter to keep the messages that exhaust their attempts.
+func WithRetryPolicy(policy RetryPolicy) SubscriberOption {
+	return func(s *subscriber) {
+		policy = policy.withDefaults(DefaultRetryPolicy())
+		s.retry = &policy
+	}
+}
+
+// withDefaults fills the settings of the policy that are missing or out of range from defaults
+func (p RetryPolicy) withDefaults(defaults RetryPolicy) RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaults.MaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaults.InitialBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = defaults.MaxBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = defaults.Multiplier
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		p.Jitter = defaults.Jitter
+	}
+	if p.MaxHold <= 0 {
+		p.MaxHold = defaults.MaxHold
+	}
+	return p
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p == nil || p.Retryable == nil {
+		return !errors.Is(err, ErrNonRetryable)
+	}
+	return p.Retryable(err)
+}
+
+func (p *RetryPolicy) holdsMessages() bool {
+	return p != nil && p.HoldMessage
+}
+
+// maxHold is the longest a message is kept unacknowledged, subscribers without a policy use the default
+func (p *RetryPolicy) maxHold() time.Duration {
+	if p == nil || p.MaxHold <= 0 {
+		return DefaultRetryPolicy().MaxHold
+	}
+	return p.MaxHold
+}
+
+// backoff is the delay after the failed attempt
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	if delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+
+	delay -= delay * p.Jitter * rand.Float64()
+	return time.Duration(delay)
+}
+
+// untilDue is how long a requeued message has to wait for its not before timestamp
+func untilDue(metadata map[string]string) time.Duration {
+	notBefore, err := time.Parse(time.RFC3339Nano, metadata[NotBeforeKey])
+	if err != nil {
+		return 0
+	}
+
+	return time.Until(notBefore)
+}
+
+// holdUntilDue keeps a requeued message until it is due and nacks it for the broker to deliver it again right away.
+// No more messages than the concurrency are held, for no longer than the hold limit so that the ack deadline
+// does not deliver them meanwhile, messages still not due by then are requeued.
+// Held messages are nacked when the subscriber stops.
+func (s *subscriber) holdUntilDue(ctx context.Context, service *Service, logger *logrus.Entry, msg *pubsub.Message, delay time.Duration) {
+	select {
+	case s.held <- struct{}{}:
+	case <-ctx.Done():
+		if msg.Nackable() {
+			msg.Nack()
+		}
+		return
+	}
+
+	hold := delay
+	if maxHold := s.retry.maxHold(); hold > maxHold {
+		hold = maxHold
+	}
+
+	go func() {
+		defer func() { <-s.held }()
+
+		if sleepContext(ctx, hold) != nil || hold == delay {
+			if msg.Nackable() {
+				msg.Nack()
+			}
+			return
+		}
+
+		s.requeueHeld(ctx, service, logger, msg)
+	}()
+}
+
+// requeueHeld publishes a message that is not due yet to the back of the requeue topic, keeping its not before timestamp.
+// Without a requeue reference it is nacked, to be held again once delivered.
+func (s *subscriber) requeueHeld(ctx context.Context, service *Service, logger *logrus.Entry, msg *pubsub.Message) {
+	if s.deadLetter == nil || s.deadLetter.requeueReference == "" {
+		if msg.Nackable() {
+			msg.Nack()
+		}
+		return
+	}
+
+	err := service.publishMessage(ctx, s.deadLetter.requeueReference, msg.Body, msg.Metadata)
+	if err != nil {
+		logger.WithError(err).Warn("could not requeue held message")
+		if msg.Nackable() {
+			msg.Nack()
+		}
+		return
+	}
+
+	msg.Ack()
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// handleWithRetries handles the message, retrying it in process while the retry policy holds messages.
+// Retries stop once the next backoff would keep the message past the hold limit, leaving it to handleFailure.
+func (s *subscriber) handleWithRetries(ctx context.Context, msg *pubsub.Message) error {
+
+	started := time.Now()
+	err := s.handle(ctx, msg)
+
+	for err != nil && s.retry.holdsMessages() && s.retry.retryable(err) {
+		attempt := deliveryAttempt(msg.Metadata)
+		if attempt >= s.maxAttempts() {
+			return err
+		}
+
+		delay := s.retry.backoff(attempt)
+		if time.Since(started)+delay > s.retry.maxHold() {
+			return err
+		}
+
+		if waitErr := sleepContext(ctx, delay); waitErr != nil {
+			return err
+		}
+
+		if msg.Metadata == nil {
+			msg.Metadata = map[string]string{}
+		}
+		msg.Metadata[DeliveryAttemptKey] = strconv.Itoa(attempt + 1)
+
+		err = s.handle(ctx, msg)
+	}
+
+	return err
+}
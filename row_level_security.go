@@ -0,0 +1,81 @@
+package frame
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+)
+
+const (
+	rowLevelSecurityPolicyName = "frame_tenant_isolation"
+
+	// rowLevelSecuritySystemSetting is set to on only for contexts marked with AsSystem and lifts the policies
+	rowLevelSecuritySystemSetting = "app.system"
+)
+
+// WithRowLevelSecurity Option that makes frame set the postgres session variables
+// app.tenant_id and app.partition_id from the authentication claims in the context,
+// app.partition_ids holds the comma separated partitions reachable by the claims
+// and app.system is on only for contexts marked with AsSystem.
+// The variables are set local to a transaction, statements that run outside a transaction
+// are wrapped in one so that the values never leak to other requests sharing a pooled connection.
+// Results read through Row, Rows or Scan outside a transaction are consumed after the statement returns,
+// such reads hold the variables on a dedicated connection that is reset before it is used again.
+// Tables are protected by creating policies using RowLevelSecurityPolicySQL or EnableRowLevelSecurity.
+func WithRowLevelSecurity() Option {
+	return func(s *Service) {
+		s.dataStore.rowLevelSecurity = true
+	}
+}
+
+// RowLevelSecurityPolicySQL generates the statements that enable row level security on a table embedding BaseModel.
+// Rows are visible and writable only when their tenant_id and partition_id are among those reachable by the claims.
+// The policy fails closed : when the variables are not set no rows are reachable,
+// only contexts marked with AsSystem reach all rows.
+// Setting force applies the policy to the owner of the table as well which is usually the application role.
+func RowLevelSecurityPolicySQL(tableName string, force bool) string {
+
+	condition := "(current_setting('" + rowLevelSecuritySystemSetting + "', true) = 'on' " +
+		"OR (COALESCE(current_setting('app.tenant_id', true), '') <> '' " +
+		"AND tenant_id = current_setting('app.tenant_id', true) " +
+		"AND partition_id = ANY(string_to_array(current_setting('app.partition_ids', true), ','))))"
+
+	statements := fmt.Sprintf("ALTER TABLE %s ENABLE ROW LEVEL SECURITY;\n", tableName)
+	if force {
+		statements += fmt.Sprintf("ALTER TABLE %s FORCE ROW LEVEL SECURITY;\n", tableName)
+	}
+	statements += fmt.Sprintf("DROP POLICY IF EXISTS %s ON %s;\n", rowLevelSecurityPolicyName, tableName)
+	statements += fmt.Sprintf("CREATE POLICY %s ON %s USING %s WITH CHECK %s;\n",
+		rowLevelSecurityPolicyName, tableName, condition, condition)
+
+	return statements
+}
+
+// EnableRowLevelSecurity creates row level security policies for the tables of the supplied models.
+// Only models that have the tenant_id and partition_id columns, typically by embedding BaseModel, are accepted.
+func (s *Service) EnableRowLevelSecurity(ctx context.Context, force bool, models ...interface{}) error {
+
+	db := s.DB(ctx, false)
+	if db == nil {
+		return errors.New("no database is setup to enable row level security")
+	}
+
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+
+		if stmt.Schema.LookUpField("tenant_id") == nil || stmt.Schema.LookUpField("partition_id") == nil {
+			return fmt.Errorf("model %s does not have tenant_id and partition_id columns", stmt.Schema.Name)
+		}
+
+		err := db.Exec(RowLevelSecurityPolicySQL(stmt.Quote(stmt.Table), force)).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package frame
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"strings"
+	"unicode"
+)
+
+const (
+	// SearchVectorColumn is the generated tsvector column holding the searchable text of a model
+	SearchVectorColumn = "search_vector"
+
+	searchTagKey          = "search"
+	searchDefaultLanguage = "english"
+	searchDefaultWeight   = "D"
+)
+
+// SearchQuery describes a full text search against the searchable fields of a model.
+type SearchQuery struct {
+	// Query is the text to look for, quoted phrases, or and leading minus signs are understood as in web search engines
+	Query string
+	// Prefix matches every word of the query as a prefix so that partially typed words find results
+	Prefix bool
+	// Language is the text search configuration used to parse the query, it defaults to that of the model
+	Language string
+	// Limit is the maximum number of results returned, zero returns all matches
+	Limit int
+	// Offset is the number of best ranked results to skip
+	Offset int
+}
+
+type searchField struct {
+	column   string
+	weight   string
+	language string
+}
+
+// searchFields lists the fields of a model tagged for full text search along with the language of the model.
+// Fields are tagged with `search:"weight:A"`, the weight ranges from A for the most important fields to D.
+// The text search configuration defaults to english and is changed by adding language to the tag of any field,
+// for example `search:"weight:B;language:simple"`.
+func searchFields(modelSchema *schema.Schema) ([]searchField, string, error) {
+
+	language := ""
+	var fields []searchField
+
+	for _, field := range modelSchema.Fields {
+		tag, ok := field.Tag.Lookup(searchTagKey)
+		if !ok || field.DBName == "" {
+			continue
+		}
+
+		sf := searchField{column: field.DBName, weight: searchDefaultWeight}
+		for key, value := range schema.ParseTagSetting(tag, ";") {
+			switch key {
+			case "WEIGHT":
+				sf.weight = strings.ToUpper(value)
+			case "LANGUAGE":
+				sf.language = value
+			}
+		}
+
+		if len(sf.weight) != 1 || sf.weight < "A" || sf.weight > "D" {
+			return nil, "", fmt.Errorf("field %s of %s has search weight %s, expected one of A, B, C or D",
+				field.Name, modelSchema.Name, sf.weight)
+		}
+
+		if sf.language != "" {
+			if language != "" && language != sf.language {
+				return nil, "", fmt.Errorf("model %s mixes the search languages %s and %s",
+					modelSchema.Name, language, sf.language)
+			}
+			language = sf.language
+		}
+
+		fields = append(fields, sf)
+	}
+
+	if language == "" {
+		language = searchDefaultLanguage
+	}
+
+	return fields, language, nil
+}
+
+// quoteLiteral quotes a value for use as a sql string literal
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// searchVectorSQL generates the statements adding the generated search vector column and its GIN index to a table.
+// The column is only added when missing, it has to be dropped for changes to the tagged fields to take effect.
+func searchVectorSQL(stmt *gorm.Statement, fields []searchField, language string) []string {
+
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		parts = append(parts, fmt.Sprintf("setweight(to_tsvector(%s, coalesce(%s::text, '')), %s)",
+			quoteLiteral(language), stmt.Quote(field.column), quoteLiteral(field.weight)))
+	}
+
+	return []string{
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s tsvector GENERATED ALWAYS AS (%s) STORED",
+			stmt.Quote(stmt.Table), stmt.Quote(SearchVectorColumn), strings.Join(parts, " || ")),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s USING GIN (%s)",
+			stmt.Quote(fmt.Sprintf("idx_%s_%s", stmt.Table, SearchVectorColumn)),
+			stmt.Quote(stmt.Table), stmt.Quote(SearchVectorColumn)),
+	}
+}
+
+// migrateSearchVectors creates the search vector columns and indexes of the supplied models that have searchable fields
+func (s *Service) migrateSearchVectors(ctx context.Context, models ...interface{}) error {
+
+	db := s.DB(ctx, false)
+	if db == nil {
+		return errors.New("no database is setup to create search vectors")
+	}
+
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+
+		fields, language, err := searchFields(stmt.Schema)
+		if err != nil {
+			return err
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		for _, statement := range searchVectorSQL(stmt, fields, language) {
+			err = db.Exec(statement).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// prefixTSQuery builds a tsquery matching every word of the text as a prefix
+func prefixTSQuery(text string) string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		terms = append(terms, word+":*")
+	}
+	return strings.Join(terms, " & ")
+}
+
+// FullTextSearch finds the rows of the repository's model matching the query against its search vector,
+// best matches first. The result has to be a pointer to a slice of the model.
+// Results are scoped to the tenant and partition of the database connections the repository was created with.
+func (repo *BaseRepository) FullTextSearch(query *SearchQuery, result interface{}) error {
+
+	db := repo.getReadDb().Session(&gorm.Session{})
+
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(repo.instanceCreator()); err != nil {
+		return err
+	}
+
+	fields, language, err := searchFields(stmt.Schema)
+	if err != nil {
+		return err
+	}
+
+	if len(fields) == 0 {
+		return fmt.Errorf("model %s has no fields tagged for search", stmt.Schema.Name)
+	}
+
+	if query.Language != "" {
+		language = query.Language
+	}
+
+	tsQuery := clause.Expr{SQL: "websearch_to_tsquery(?, ?)", Vars: []interface{}{language, query.Query}}
+	if query.Prefix {
+		tsQuery = clause.Expr{SQL: "to_tsquery(?, ?)", Vars: []interface{}{language, prefixTSQuery(query.Query)}}
+	}
+
+	vectorColumn := clause.Column{Table: clause.CurrentTable, Name: SearchVectorColumn}
+
+	db = db.Model(repo.instanceCreator()).
+		Where("? @@ ?", vectorColumn, tsQuery).
+		Clauses(clause.OrderBy{Expression: clause.Expr{
+			SQL:                "ts_rank(?, ?) DESC, ? ASC",
+			Vars:               []interface{}{vectorColumn, tsQuery, clause.Column{Table: clause.CurrentTable, Name: "id"}},
+			WithoutParentheses: true,
+		}})
+
+	if query.Limit > 0 {
+		db = db.Limit(query.Limit)
+	}
+
+	if query.Offset > 0 {
+		db = db.Offset(query.Offset)
+	}
+
+	return db.Find(result).Error
+}
@@ -0,0 +1,291 @@
+package frame
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Fixture holds seed rows of a model registered with WithSeedModel.
+// Rows map column names to values, rows carrying a tenant_id and partition_id are written on behalf of that tenant.
+// Key lists the columns identifying a row so that seeding again updates it instead of adding a copy, it defaults to id.
+type Fixture struct {
+	Model string                   `json:"model" yaml:"model"`
+	Key   []string                 `json:"key" yaml:"key"`
+	Rows  []map[string]interface{} `json:"rows" yaml:"rows"`
+}
+
+// namedModel is a model registered under a name along with the names of the models it depends on
+type namedModel struct {
+	name      string
+	model     interface{}
+	dependsOn []string
+}
+
+// WithSeedModel Option registers a model fixtures can seed under the supplied name.
+// Fixtures of the models it depends on are always loaded before its own.
+func WithSeedModel(name string, model interface{}, dependsOn ...string) Option {
+	return func(s *Service) {
+		s.dataStore.seedModels = append(s.dataStore.seedModels, namedModel{name: name, model: model, dependsOn: dependsOn})
+	}
+}
+
+// readFixtures reads the json and yaml fixture files at the root of the file system ordered by name,
+// a file holds either a single fixture or a list of them
+func readFixtures(fsys fs.FS) ([]Fixture, error) {
+
+	var files []string
+	for _, pattern := range []string{"*.json", "*.yaml", "*.yml"} {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+
+	var fixtures []Fixture
+	for _, file := range files {
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		unmarshal := yaml.Unmarshal
+		if path.Ext(file) == ".json" {
+			unmarshal = json.Unmarshal
+		}
+
+		var fileFixtures []Fixture
+		if err = unmarshal(content, &fileFixtures); err != nil {
+			var fixture Fixture
+			if singleErr := unmarshal(content, &fixture); singleErr != nil {
+				return nil, fmt.Errorf("could not read fixtures from %s : %w", file, err)
+			}
+			fileFixtures = []Fixture{fixture}
+		}
+
+		fixtures = append(fixtures, fileFixtures...)
+	}
+
+	return fixtures, nil
+}
+
+// seedOrder sorts the registered seed models so that every model follows the models it depends on
+func (s *Service) seedOrder() ([]namedModel, error) {
+	return orderModels("seed", s.dataStore.seedModels)
+}
+
+// orderModels sorts the models so that every model follows the models it depends on,
+// the kind names the registration in errors
+func orderModels(kind string, models []namedModel) ([]namedModel, error) {
+
+	modelsByName := map[string]namedModel{}
+	for _, model := range models {
+		modelsByName[model.name] = model
+	}
+
+	var ordered []namedModel
+	state := map[string]int{}
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		model, ok := modelsByName[name]
+		if !ok {
+			return fmt.Errorf("%s model %s is not registered", kind, name)
+		}
+
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("%s model %s depends on itself", kind, name)
+		case 2:
+			return nil
+		}
+
+		state[name] = 1
+		for _, dependency := range model.dependsOn {
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+
+		ordered = append(ordered, model)
+		return nil
+	}
+
+	for _, model := range models {
+		if err := visit(model.name); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
+
+// Seed runs the seed command in args, usually the command line arguments of a binary started as app seed.
+// The fixture directories following the command take precedence over the seed path of the configuration.
+// Nothing is seeded unless the command is given or the configuration turns seeding on.
+func (s *Service) Seed(ctx context.Context, args []string) error {
+
+	config, _ := s.Config().(ConfigurationSeeding)
+
+	isCommand := len(args) > 0 && args[0] == "seed"
+	if !isCommand && (config == nil || !config.DoDatabaseSeed()) {
+		return nil
+	}
+
+	seedPath := ""
+	if isCommand && len(args) > 1 {
+		seedPath = strings.Join(args[1:], ",")
+	} else if config != nil {
+		seedPath = config.GetDatabaseSeedPath()
+	}
+
+	if seedPath == "" {
+		return errors.New("no seed path is configured")
+	}
+
+	return s.SeedDatastore(AsSystem(ctx), seedPath)
+}
+
+// SeedDatastore loads the fixture files found in the seed path, a comma separated list of directories
+// usually holding the fixtures of the environment such as ./seeds/staging.
+// Seeding is idempotent, rows already present are matched by the key of their fixture and updated.
+func (s *Service) SeedDatastore(ctx context.Context, seedPath string) error {
+
+	var fixtures []Fixture
+	for _, dir := range strings.Split(seedPath, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+
+		dirFixtures, err := readFixtures(os.DirFS(dir))
+		if err != nil {
+			log.Printf("SeedDatastore -- could not read fixtures from %s : %s", dir, err)
+			return err
+		}
+
+		fixtures = append(fixtures, dirFixtures...)
+	}
+
+	return s.LoadFixtures(ctx, fixtures...)
+}
+
+// LoadFixtures seeds the supplied fixtures in the dependency order of their models,
+// it is how tests set up the data they depend on.
+func (s *Service) LoadFixtures(ctx context.Context, fixtures ...Fixture) error {
+
+	fixturesByModel := map[string][]Fixture{}
+	for _, fixture := range fixtures {
+		fixturesByModel[fixture.Model] = append(fixturesByModel[fixture.Model], fixture)
+	}
+
+	models, err := s.seedOrder()
+	if err != nil {
+		return err
+	}
+
+	for _, model := range models {
+		for _, fixture := range fixturesByModel[model.name] {
+			for _, row := range fixture.Rows {
+				err = s.seedRow(ctx, model, fixture.Key, row)
+				if err != nil {
+					return fmt.Errorf("could not seed %s : %w", model.name, err)
+				}
+			}
+		}
+		delete(fixturesByModel, model.name)
+	}
+
+	for name := range fixturesByModel {
+		return fmt.Errorf("seed model %s is not registered", name)
+	}
+
+	return nil
+}
+
+// seedRow creates the row or updates the one sharing its natural key
+func (s *Service) seedRow(ctx context.Context, model namedModel, key []string, row map[string]interface{}) error {
+
+	tenantID, _ := row["tenant_id"].(string)
+	partitionID, _ := row["partition_id"].(string)
+	if tenantID != "" && partitionID != "" {
+		accessID, _ := row["access_id"].(string)
+		claims := &AuthenticationClaims{TenantID: tenantID, PartitionID: partitionID, AccessID: accessID}
+		// Rows carrying their tenant are written on behalf of it even when seeding as the system
+		ctx = claims.ClaimsToContext(withoutSystem(ctx))
+	}
+
+	db := s.DB(ctx, false)
+	if db == nil {
+		return errors.New("no database is setup to seed")
+	}
+
+	modelType := reflect.Indirect(reflect.ValueOf(model.model)).Type()
+	instance := reflect.New(modelType)
+
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(instance.Interface()); err != nil {
+		return err
+	}
+
+	columns := make([]string, 0, len(row))
+	for column, value := range row {
+		field := stmt.Schema.LookUpField(column)
+		if field == nil {
+			return fmt.Errorf("%s has no column %s", model.name, column)
+		}
+
+		if err := field.Set(ctx, instance.Elem(), value); err != nil {
+			return fmt.Errorf("invalid value for %s : %w", column, err)
+		}
+		columns = append(columns, field.DBName)
+	}
+
+	if len(key) == 0 {
+		key = []string{"id"}
+	}
+
+	conditions := make([]clause.Expression, 0, len(key))
+	for _, column := range key {
+		if _, ok := row[column]; !ok {
+			return fmt.Errorf("row is missing the key column %s", column)
+		}
+
+		field := stmt.Schema.LookUpField(column)
+		value := field.ReflectValueOf(ctx, instance.Elem()).Interface()
+		conditions = append(conditions, clause.Eq{Column: clause.Column{Name: field.DBName}, Value: value})
+	}
+
+	existing := reflect.New(modelType).Interface()
+	err := s.DB(ctx, false).Where(clause.And(conditions...)).First(existing).Error
+	if err != nil {
+		if !DBErrorIsRecordNotFound(err) {
+			return err
+		}
+
+		return s.DB(ctx, false).Create(instance.Interface()).Error
+	}
+
+	if primaryField := stmt.Schema.PrioritizedPrimaryField; primaryField != nil {
+		err = primaryField.Set(ctx, instance.Elem(), primaryField.ReflectValueOf(ctx, reflect.ValueOf(existing).Elem()).Interface())
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.DB(ctx, false).Model(existing).Select(columns).Updates(instance.Interface()).Error
+}
@@ -96,8 +96,9 @@ func NewService(name string, opts ...Option) (context.Context, *Service) {
 		cancelFunc:   cancel,
 		errorChannel: make(chan error, 1),
 		dataStore: &store{
-			readDatabase:  []*gorm.DB{},
-			writeDatabase: []*gorm.DB{},
+			readDatabase:       []*gorm.DB{},
+			writeDatabase:      []*gorm.DB{},
+			slowQueryThreshold: defaultSlowQueryThreshold,
 		},
 		client:          &http.Client{},
 		queue:           q,
@@ -214,9 +215,6 @@ func (s *Service) AddCleanupMethod(f func(ctx context.Context)) {
 // The arguments are implementations of the checker interface and should work with just about
 // any system that is given to them.
 func (s *Service) AddHealthCheck(checker Checker) {
-	if s.healthCheckers != nil {
-		s.healthCheckers = []Checker{}
-	}
 	s.healthCheckers = append(s.healthCheckers, checker)
 }
 
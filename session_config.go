@@ -0,0 +1,263 @@
+package frame
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+	"strings"
+)
+
+const (
+	sessionConfigTransactionKey = "frame:session_config_started_transaction"
+	sessionConfigConnectionKey  = "frame:session_config_pinned_connection"
+)
+
+// sessionConfigPlugin gorm plugin that applies per request postgres settings before each statement.
+// It carries the tenant variables used by row level security policies and the search_path of schema isolated tenants.
+// Settings are local to a transaction, statements that run outside a transaction are wrapped in one
+// so that the values never leak to other requests sharing a pooled connection.
+// Rows are read after the statement callbacks return, outside a transaction they are read from a connection
+// pinned for the statement that holds the settings for its session until resetSession clears them.
+// Statements on a connection pinned by withPinnedConnection get the settings for its session.
+type sessionConfigPlugin struct {
+	store *store
+}
+
+func (p *sessionConfigPlugin) Name() string {
+	return "frame:session_config"
+}
+
+func (p *sessionConfigPlugin) Initialize(db *gorm.DB) error {
+
+	type registrar interface {
+		Register(name string, fn func(*gorm.DB)) error
+	}
+
+	processors := []struct {
+		before registrar
+		after  registrar
+	}{
+		{db.Callback().Create().Before("*"), db.Callback().Create().After("*")},
+		{db.Callback().Query().Before("*"), db.Callback().Query().After("*")},
+		{db.Callback().Update().Before("*"), db.Callback().Update().After("*")},
+		{db.Callback().Delete().Before("*"), db.Callback().Delete().After("*")},
+		{db.Callback().Raw().Before("*"), db.Callback().Raw().After("*")},
+	}
+
+	for _, processor := range processors {
+		err := processor.before.Register("frame:session_set_config", p.setConfig)
+		if err != nil {
+			return err
+		}
+		err = processor.after.Register("frame:session_commit_or_rollback", p.commitOrRollback)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := db.Callback().Row().Before("*").Register("frame:session_set_config", p.setRowConfig)
+	if err != nil {
+		return err
+	}
+	return db.Callback().Row().After("*").Register("frame:session_release_connection", p.releaseConnection)
+}
+
+// settings lists the postgres settings required by the statement as name and value pairs.
+// Statements on a pinned connection set every value as the connection keeps those of earlier statements.
+func (p *sessionConfigPlugin) settings(db *gorm.DB, inTransaction bool) ([]string, error) {
+	ctx := db.Statement.Context
+	var settings []string
+
+	pinned := statementPinnedPool(db)
+	inTransaction = inTransaction || pinned != nil
+
+	if p.store.rowLevelSecurity {
+		authClaim := tenantClaims(ctx)
+		if IsSystem(ctx) {
+			settings = append(settings, rowLevelSecuritySystemSetting, "on",
+				"app.tenant_id", "", "app.partition_id", "", "app.partition_ids", "")
+		} else if authClaim != nil {
+			settings = append(settings, rowLevelSecuritySystemSetting, "off",
+				"app.tenant_id", authClaim.TenantID,
+				"app.partition_id", authClaim.PartitionID,
+				"app.partition_ids", strings.Join(p.store.accessiblePartitions(ctx, authClaim), ","))
+		} else if inTransaction {
+			settings = append(settings, rowLevelSecuritySystemSetting, "off",
+				"app.tenant_id", "", "app.partition_id", "", "app.partition_ids", "")
+		}
+	}
+
+	if p.store.routing != nil {
+		schema, err := p.store.routing.schema(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if schema != "" {
+			settings = append(settings, "search_path", quoteSchema(schema))
+		} else if pinned != nil {
+			settings = append(settings, "search_path", pinned.searchPath)
+		}
+	}
+
+	return settings, nil
+}
+
+// setConfig applies the settings, when the statement is not part of a transaction one is started to hold them
+func (p *sessionConfigPlugin) setConfig(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+
+	_, inTransaction := db.Statement.ConnPool.(gorm.TxCommitter)
+
+	settings, err := p.settings(db, inTransaction)
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+	if len(settings) == 0 {
+		return
+	}
+
+	if !inTransaction && statementPinnedPool(db) != nil {
+		p.applySettings(db, settings, false)
+		return
+	}
+
+	if !inTransaction {
+		tx := db.Begin()
+		if tx.Error != nil {
+			_ = db.AddError(tx.Error)
+			return
+		}
+		db.Statement.ConnPool = tx.Statement.ConnPool
+		db.InstanceSet(sessionConfigTransactionKey, true)
+	}
+
+	p.applySettings(db, settings, true)
+}
+
+// setRowConfig applies the settings for statements whose rows are read after the callbacks return.
+// Outside a transaction the statement is pinned to a connection holding the settings for its session.
+func (p *sessionConfigPlugin) setRowConfig(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+
+	_, inTransaction := db.Statement.ConnPool.(gorm.TxCommitter)
+
+	settings, err := p.settings(db, inTransaction)
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+	if len(settings) == 0 {
+		return
+	}
+
+	if inTransaction {
+		p.applySettings(db, settings, true)
+		return
+	}
+
+	if statementPinnedPool(db) != nil {
+		p.applySettings(db, settings, false)
+		return
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+
+	conn, err := p.store.pinConnection(db.Statement.Context, sqlDB)
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+
+	db.Statement.ConnPool = conn
+	db.InstanceSet(sessionConfigConnectionKey, conn)
+	p.applySettings(db, settings, false)
+}
+
+// applySettings sets the settings for the current transaction when local or for the whole session otherwise
+func (p *sessionConfigPlugin) applySettings(db *gorm.DB, settings []string, local bool) {
+	var calls []string
+	args := make([]interface{}, len(settings))
+	for i := 0; i < len(settings); i += 2 {
+		calls = append(calls, fmt.Sprintf("set_config($%d, $%d, %t)", i+1, i+2, local))
+		args[i], args[i+1] = settings[i], settings[i+1]
+	}
+
+	_, err := db.Statement.ConnPool.ExecContext(db.Statement.Context,
+		"SELECT "+strings.Join(calls, ", "), args...)
+	if err != nil {
+		_ = db.AddError(err)
+	}
+}
+
+// releaseConnection hands the connection pinned by setRowConfig back to the pool.
+// Closing it waits for the rows read from it to be closed, so it happens in the background.
+func (p *sessionConfigPlugin) releaseConnection(db *gorm.DB) {
+	value, ok := db.InstanceGet(sessionConfigConnectionKey)
+	if !ok {
+		return
+	}
+
+	db.Statement.ConnPool = db.ConnPool
+
+	conn := value.(*sql.Conn)
+	go func() {
+		_ = conn.Close()
+	}()
+}
+
+// markSessionConfigured records a connection holding session settings so that resetSession clears them,
+// connections that were closed in the meantime are forgotten
+func (st *store) markSessionConfigured(conn *pgx.Conn) {
+	st.sessionConfigured.Range(func(key, _ any) bool {
+		if key.(*pgx.Conn).IsClosed() {
+			st.sessionConfigured.Delete(key)
+		}
+		return true
+	})
+	st.sessionConfigured.Store(conn, true)
+}
+
+// resetSession clears the session settings of a connection before it is reused
+func (st *store) resetSession(ctx context.Context, conn *pgx.Conn) error {
+	if _, ok := st.sessionConfigured.LoadAndDelete(conn); !ok {
+		return nil
+	}
+
+	_, err := conn.Exec(ctx, "RESET ALL")
+	if err != nil {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+// commitOrRollback ends the transaction started by setConfig if any
+func (p *sessionConfigPlugin) commitOrRollback(db *gorm.DB) {
+	if _, ok := db.InstanceGet(sessionConfigTransactionKey); !ok {
+		return
+	}
+
+	if db.Error != nil {
+		db.Rollback()
+	} else {
+		db.Commit()
+	}
+
+	db.Statement.ConnPool = db.ConnPool
+}
+
+// quoteSchema quotes a schema name for use as an sql identifier
+func quoteSchema(schema string) string {
+	return `"` + strings.ReplaceAll(schema, `"`, `""`) + `"`
+}
@@ -0,0 +1,40 @@
+package frame
+
+import (
+	"context"
+)
+
+// WithDedicatedPool SubscriberOption handles the messages of the subscriber on its own workers instead of the service pool,
+// so a busy subscription neither starves other subscriptions nor the jobs submitted by the service.
+func WithDedicatedPool() SubscriberOption {
+	return func(s *subscriber) {
+		s.dedicated = true
+	}
+}
+
+// acquire takes an in flight slot, waiting for one to free up, it fails only when the context is done
+func (s *subscriber) acquire(ctx context.Context) bool {
+	select {
+	case s.inFlight <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *subscriber) release() {
+	select {
+	case <-s.inFlight:
+	default:
+	}
+}
+
+// submit runs the job of a message on the dedicated pool of the subscriber or on the service pool
+func (s *subscriber) submit(ctx context.Context, service *Service, job Job) error {
+
+	if s.pool == nil {
+		return service.SubmitJob(ctx, job)
+	}
+
+	return service.submitJobToPool(ctx, s.pool, job)
+}
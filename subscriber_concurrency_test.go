@@ -0,0 +1,138 @@
+package frame_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/pitabwire/frame"
+	"sync"
+	"testing"
+	"time"
+)
+
+type concurrencyHandler struct {
+	mutex       sync.Mutex
+	inFlight    int
+	maxInFlight int
+	handled     int
+	delay       time.Duration
+	release     chan struct{}
+	started     chan struct{}
+	done        chan struct{}
+}
+
+func newConcurrencyHandler(delay time.Duration, release chan struct{}) *concurrencyHandler {
+	return &concurrencyHandler{delay: delay, release: release, started: make(chan struct{}, 100), done: make(chan struct{}, 100)}
+}
+
+func (h *concurrencyHandler) Handle(ctx context.Context, metadata map[string]string, message []byte) error {
+	h.mutex.Lock()
+	h.inFlight++
+	if h.inFlight > h.maxInFlight {
+		h.maxInFlight = h.inFlight
+	}
+	h.mutex.Unlock()
+	h.started <- struct{}{}
+	defer func() {
+		h.done <- struct{}{}
+	}()
+
+	if h.release != nil {
+		<-h.release
+	}
+	time.Sleep(h.delay)
+
+	h.mutex.Lock()
+	h.inFlight--
+	h.handled++
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *concurrencyHandler) stats() (int, int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.maxInFlight, h.handled
+}
+
+func TestService_SubscriberConcurrencyLimit(t *testing.T) {
+	handler := newConcurrencyHandler(20*time.Millisecond, nil)
+
+	ctx, srv := frame.NewService("Test Srv", frame.NoopDriver(), frame.WithPoolConcurrency(10),
+		frame.RegisterPublisher("limited", "mem://limitedWork"),
+		frame.RegisterSubscriber("limited", "mem://limitedWork", 2, handler))
+
+	err := srv.Run(ctx, "")
+	if err != nil {
+		t.Errorf("We couldn't instantiate queue  %s", err)
+		return
+	}
+	defer srv.Stop(ctx)
+
+	for i := 0; i < 10; i++ {
+		err = srv.Publish(ctx, "limited", []byte(fmt.Sprintf("message %d", i)))
+		if err != nil {
+			t.Errorf("We could not publish to topic that was registered %s", err)
+			return
+		}
+	}
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < 10; i++ {
+		select {
+		case <-handler.done:
+		case <-timeout:
+			t.Errorf("Only %d of the messages were handled in time", i)
+			return
+		}
+	}
+
+	maxInFlight, handled := handler.stats()
+	if handled != 10 || maxInFlight > 2 {
+		t.Errorf("Expected all messages handled two at a time but handled %d with up to %d in flight", handled, maxInFlight)
+	}
+}
+
+func TestService_SubscriberDedicatedPool(t *testing.T) {
+	handler := newConcurrencyHandler(0, make(chan struct{}))
+
+	ctx, srv := frame.NewService("Test Srv", frame.NoopDriver(), frame.WithPoolConcurrency(1),
+		frame.RegisterPublisher("dedicated", "mem://dedicatedWork"),
+		frame.RegisterSubscriber("dedicated", "mem://dedicatedWork", 1, handler, frame.WithDedicatedPool()))
+
+	err := srv.Run(ctx, "")
+	if err != nil {
+		t.Errorf("We couldn't instantiate queue  %s", err)
+		return
+	}
+	defer srv.Stop(ctx)
+	defer close(handler.release)
+
+	err = srv.Publish(ctx, "dedicated", []byte("blocking"))
+	if err != nil {
+		t.Errorf("We could not publish to topic that was registered %s", err)
+		return
+	}
+
+	select {
+	case <-handler.started:
+	case <-time.After(5 * time.Second):
+		t.Errorf("The blocking message was not handled")
+		return
+	}
+
+	done := make(chan struct{})
+	err = srv.SubmitJob(ctx, srv.NewJob(func(ctx context.Context) error {
+		close(done)
+		return nil
+	}))
+	if err != nil {
+		t.Errorf("Could not submit job : %s", err)
+		return
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("A busy subscriber with a dedicated pool should not starve the service pool")
+	}
+}
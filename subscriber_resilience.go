@@ -0,0 +1,105 @@
+package frame
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// SubscriptionState is the state of a subscription as reported by its health check
+type SubscriptionState string
+
+const (
+	// SubscriptionConnecting the subscription is being opened
+	SubscriptionConnecting SubscriptionState = "connecting"
+	// SubscriptionActive the subscription is receiving messages
+	SubscriptionActive SubscriptionState = "active"
+	// SubscriptionDegraded receiving failed and the subscription is waiting to be reopened
+	SubscriptionDegraded SubscriptionState = "degraded"
+)
+
+// DefaultReconnectPolicy reopens a failing subscription up to 10 times in a row,
+// starting with a one second delay doubling up to thirty seconds
+func DefaultReconnectPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    10,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// WithReconnectPolicy SubscriberOption controls how the subscription is reopened when receiving messages fails.
+// MaxAttempts is the failure budget : once receiving fails that many times in a row the service is stopped,
+// errors the Retryable function of the policy rejects stop the service right away.
+func WithReconnectPolicy(policy RetryPolicy) SubscriberOption {
+	return func(s *subscriber) {
+		policy = policy.withDefaults(DefaultReconnectPolicy())
+		s.reconnectPolicy = &policy
+	}
+}
+
+func (s *subscriber) setState(state SubscriptionState) {
+	s.state.Store(state)
+}
+
+func (s *subscriber) currentState() SubscriptionState {
+	state, ok := s.state.Load().(SubscriptionState)
+	if !ok {
+		return SubscriptionConnecting
+	}
+	return state
+}
+
+// CheckHealth reports the subscriber as unhealthy while its subscription is not active
+func (s *subscriber) CheckHealth() error {
+	state := s.currentState()
+	if state != SubscriptionActive {
+		return fmt.Errorf("subscription %s is %s", s.reference, state)
+	}
+	return nil
+}
+
+// reconnect reopens the subscription after receiving failed, backing off between attempts.
+// An error is returned when the failure budget is spent or the failure can not be retried.
+func (s *subscriber) reconnect(ctx context.Context, service *Service, logger *logrus.Entry, cause error) error {
+	for ctx.Err() == nil {
+		s.failures++
+		s.setState(SubscriptionDegraded)
+
+		if !s.reconnectPolicy.retryable(cause) {
+			return fmt.Errorf("subscription %s failed : %w", s.reference, cause)
+		}
+
+		if s.failures >= s.reconnectPolicy.MaxAttempts {
+			return fmt.Errorf("subscription %s failed %d times in a row : %w", s.reference, s.failures, cause)
+		}
+
+		logger.WithError(cause).WithField("failures", s.failures).Warn(" reopening subscription")
+
+		err := sleepContext(ctx, s.reconnectPolicy.backoff(s.failures))
+		if err != nil {
+			return nil
+		}
+
+		s.setState(SubscriptionConnecting)
+		err = service.reopenSubscriber(ctx, s)
+		if err == nil {
+			s.setState(SubscriptionActive)
+			return nil
+		}
+		cause = err
+	}
+	return nil
+}
+
+// SubscriptionState reports whether the subscription registered with the reference is connecting, active or degraded
+func (s *Service) SubscriptionState(path string) SubscriptionState {
+	sub, ok := s.queue.subscriptionQueueMap.Load(path)
+	if !ok {
+		return ""
+	}
+	return sub.(*subscriber).currentState()
+}
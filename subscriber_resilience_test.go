@@ -0,0 +1,141 @@
+package frame
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type countingHandler struct {
+	handled chan []byte
+}
+
+func newCountingHandler() *countingHandler {
+	return &countingHandler{handled: make(chan []byte, 10)}
+}
+
+func (h *countingHandler) Handle(_ context.Context, _ map[string]string, message []byte) error {
+	h.handled <- message
+	return nil
+}
+
+// eventually reports whether the condition holds before the timeout, checking it on every tick
+func eventually(condition func() bool, timeout time.Duration, tick time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for !condition() {
+		select {
+		case <-deadline.C:
+			return condition()
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+func waitForState(srv *Service, reference string, state SubscriptionState) bool {
+	return eventually(func() bool {
+		return srv.SubscriptionState(reference) == state
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestSubscriberReconnects(t *testing.T) {
+	handler := newCountingHandler()
+
+	ctx, srv := NewService("Test Srv", NoopDriver(),
+		RegisterPublisher("reconnecting", "mem://reconnectingWork"),
+		RegisterSubscriber("reconnecting", "mem://reconnectingWork", 1, handler,
+			WithReconnectPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: 50 * time.Millisecond})))
+
+	err := srv.Run(ctx, "")
+	if err != nil {
+		t.Errorf("We couldn't instantiate queue  %s", err)
+		return
+	}
+	defer srv.Stop(ctx)
+
+	if srv.SubscriptionState("reconnecting") != SubscriptionActive {
+		t.Errorf("Subscription should be active once the service runs but is %s", srv.SubscriptionState("reconnecting"))
+		return
+	}
+
+	sub, _ := srv.queue.subscriptionQueueMap.Load("reconnecting")
+	err = sub.(*subscriber).subscription.Load().Shutdown(ctx)
+	if err != nil {
+		t.Errorf("Could not shut down the subscription : %s", err)
+		return
+	}
+
+	if !waitForState(srv, "reconnecting", SubscriptionDegraded) {
+		t.Errorf("Subscription should be degraded after receiving failed")
+		return
+	}
+
+	unhealthy := false
+	for _, checker := range srv.HealthCheckers() {
+		if checker.CheckHealth() != nil {
+			unhealthy = true
+		}
+	}
+	if !unhealthy {
+		t.Errorf("A degraded subscription should fail its health check")
+	}
+
+	if !waitForState(srv, "reconnecting", SubscriptionActive) {
+		t.Errorf("Subscription should be active again once reopened but is %s", srv.SubscriptionState("reconnecting"))
+		return
+	}
+
+	err = srv.Publish(ctx, "reconnecting", []byte("after reconnect"))
+	if err != nil {
+		t.Errorf("We could not publish to topic that was registered %s", err)
+		return
+	}
+
+	select {
+	case message := <-handler.handled:
+		if string(message) != "after reconnect" {
+			t.Errorf("Unexpected message %s", message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Message published after reconnecting was not handled")
+	}
+}
+
+func TestSubscriberFailureBudgetStopsService(t *testing.T) {
+
+	ctx, srv := NewService("Test Srv", NoopDriver(),
+		RegisterPublisher("failing", "mem://failingWork"),
+		RegisterSubscriber("failing", "mem://failingWork", 1, newCountingHandler(),
+			WithReconnectPolicy(RetryPolicy{MaxAttempts: 1})))
+
+	err := srv.Run(ctx, "")
+	if err != nil {
+		t.Errorf("We couldn't instantiate queue  %s", err)
+		return
+	}
+	defer srv.Stop(ctx)
+
+	sub, _ := srv.queue.subscriptionQueueMap.Load("failing")
+	err = sub.(*subscriber).subscription.Load().Shutdown(ctx)
+	if err != nil {
+		t.Errorf("Could not shut down the subscription : %s", err)
+		return
+	}
+
+	select {
+	case err = <-srv.errorChannel:
+		if err == nil || srv.SubscriptionIsInitiated("failing") {
+			t.Errorf("Service should be stopped with the subscription error but got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Spending the failure budget should stop the service")
+	}
+
+	if srv.SubscriptionState("failing") != SubscriptionDegraded {
+		t.Errorf("Subscription should be left degraded but is %s", srv.SubscriptionState("failing"))
+	}
+}
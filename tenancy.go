@@ -0,0 +1,237 @@
+package frame
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+)
+
+// ErrTenantMismatch is returned when a write targets data of a tenant or partition other than the caller's
+var ErrTenantMismatch = errors.New("tenant or partition does not match the authentication claims")
+
+// tenancyPlugin gorm plugin that enforces the tenant and partition of the authentication claims on writes.
+// Reads are already restricted by the tenantPartition scope applied in DB.
+type tenancyPlugin struct {
+	store *store
+}
+
+func (p *tenancyPlugin) Name() string {
+	return "frame:tenancy"
+}
+
+func (p *tenancyPlugin) Initialize(db *gorm.DB) error {
+	err := db.Callback().Create().Before("gorm:create").Register("frame:tenancy_create", p.enforceCreate)
+	if err != nil {
+		return err
+	}
+
+	err = db.Callback().Update().Before("gorm:update").Register("frame:tenancy_update", p.enforceUpdate)
+	if err != nil {
+		return err
+	}
+
+	return db.Callback().Delete().Before("gorm:delete").Register("frame:tenancy_delete", p.enforceDelete)
+}
+
+// tenancyFields returns the tenant and partition fields of the statement's model if it has both
+func tenancyFields(db *gorm.DB) (*schema.Field, *schema.Field, bool) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return nil, nil, false
+	}
+
+	tenantField := db.Statement.Schema.LookUpField("tenant_id")
+	partitionField := db.Statement.Schema.LookUpField("partition_id")
+	return tenantField, partitionField, tenantField != nil && partitionField != nil
+}
+
+// enforceCreate fills in missing tenant fields and rejects rows belonging to another tenant.
+// Upserts are restricted so that a conflicting row of another tenant is never overwritten.
+func (p *tenancyPlugin) enforceCreate(db *gorm.DB) {
+	authClaim := tenantClaims(db.Statement.Context)
+	if authClaim == nil {
+		return
+	}
+
+	tenantField, partitionField, ok := tenancyFields(db)
+	if !ok {
+		return
+	}
+
+	partitions := p.store.accessiblePartitions(db.Statement.Context, authClaim)
+
+	err := walkReflectValue(db.Statement.ReflectValue, func(value reflect.Value) error {
+		err := assignOrMatch(db, tenantField, value, authClaim.TenantID)
+		if err != nil {
+			return err
+		}
+		return assignOrMatch(db, partitionField, value, authClaim.PartitionID, partitions...)
+	})
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+
+	if c, ok := db.Statement.Clauses[clause.OnConflict{}.Name()]; ok {
+		if onConflict, ok := c.Expression.(clause.OnConflict); ok && !onConflict.DoNothing {
+			onConflict.Where.Exprs = append(onConflict.Where.Exprs,
+				clause.Eq{Column: clause.Column{Table: db.Statement.Table, Name: tenantField.DBName}, Value: authClaim.TenantID},
+				clause.IN{Column: clause.Column{Table: db.Statement.Table, Name: partitionField.DBName}, Values: toInterfaces(partitions)},
+			)
+			db.Statement.AddClause(onConflict)
+		}
+	}
+}
+
+// enforceUpdate rejects updates of models or assignments that would move data into another tenant
+func (p *tenancyPlugin) enforceUpdate(db *gorm.DB) {
+	authClaim := tenantClaims(db.Statement.Context)
+	if authClaim == nil {
+		return
+	}
+
+	tenantField, partitionField, ok := tenancyFields(db)
+	if !ok {
+		return
+	}
+
+	partitions := p.store.accessiblePartitions(db.Statement.Context, authClaim)
+
+	if value, ok := updatedValue(db, tenantField); ok && value != authClaim.TenantID {
+		_ = db.AddError(ErrTenantMismatch)
+		return
+	}
+
+	if value, ok := updatedValue(db, partitionField); ok && !containsValue(partitions, value) {
+		_ = db.AddError(ErrTenantMismatch)
+		return
+	}
+
+	p.matchExisting(db, tenantField, partitionField, authClaim.TenantID, partitions)
+}
+
+// enforceDelete rejects deletion of models that belong to another tenant
+func (p *tenancyPlugin) enforceDelete(db *gorm.DB) {
+	authClaim := tenantClaims(db.Statement.Context)
+	if authClaim == nil {
+		return
+	}
+
+	tenantField, partitionField, ok := tenancyFields(db)
+	if !ok {
+		return
+	}
+
+	p.matchExisting(db, tenantField, partitionField, authClaim.TenantID,
+		p.store.accessiblePartitions(db.Statement.Context, authClaim))
+}
+
+// matchExisting verifies that any tenant fields already set on the statement's values match the claims
+func (p *tenancyPlugin) matchExisting(db *gorm.DB, tenantField, partitionField *schema.Field,
+	tenantID string, partitions []string) {
+	err := walkReflectValue(db.Statement.ReflectValue, func(value reflect.Value) error {
+		tenant, isZero := tenantField.ValueOf(db.Statement.Context, value)
+		if !isZero && tenant != tenantID {
+			return ErrTenantMismatch
+		}
+
+		partition, isZero := partitionField.ValueOf(db.Statement.Context, value)
+		if !isZero && !containsValue(partitions, partition) {
+			return ErrTenantMismatch
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.AddError(err)
+	}
+}
+
+// updatedValue returns the value an update assigns to the field, whether the assignments are a map or a struct.
+// Zero values of struct assignments are left out as gorm does not write them.
+func updatedValue(db *gorm.DB, field *schema.Field) (interface{}, bool) {
+	if assignments, ok := db.Statement.Dest.(map[string]interface{}); ok {
+		for key, value := range assignments {
+			if db.Statement.Schema.LookUpField(key) == field {
+				return value, true
+			}
+		}
+		return nil, false
+	}
+
+	destValue := reflect.Indirect(reflect.ValueOf(db.Statement.Dest))
+	if destValue.Kind() != reflect.Struct {
+		return nil, false
+	}
+
+	destField := field
+	if destValue.Type() != db.Statement.Schema.ModelType {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(db.Statement.Dest); err != nil {
+			return nil, false
+		}
+
+		destField = stmt.Schema.LookUpField(field.DBName)
+		if destField == nil {
+			return nil, false
+		}
+	}
+
+	value, isZero := destField.ValueOf(db.Statement.Context, destValue)
+	if isZero {
+		return nil, false
+	}
+	return value, true
+}
+
+// assignOrMatch sets the field to the expected value when empty and fails if it holds a value that is not allowed.
+// Without explicitly allowed values only the expected value is accepted.
+func assignOrMatch(db *gorm.DB, field *schema.Field, value reflect.Value, expected string, allowed ...string) error {
+	current, isZero := field.ValueOf(db.Statement.Context, value)
+	if isZero {
+		return field.Set(db.Statement.Context, value, expected)
+	}
+
+	if len(allowed) == 0 {
+		allowed = []string{expected}
+	}
+
+	if !containsValue(allowed, current) {
+		return ErrTenantMismatch
+	}
+	return nil
+}
+
+// containsValue checks if value is one of the supplied strings
+func containsValue(values []string, value interface{}) bool {
+	for _, v := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func toInterfaces(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, v := range values {
+		result[i] = v
+	}
+	return result
+}
+
+// walkReflectValue calls fn for the struct held by value or for every struct in a slice or array
+func walkReflectValue(value reflect.Value, fn func(value reflect.Value) error) error {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			err := walkReflectValue(reflect.Indirect(value.Index(i)), fn)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		return fn(value)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package frame
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"os"
+	"reflect"
+)
+
+// tenantDataRecord is a line of a tenant export, the data is the json encoding of the model
+type tenantDataRecord struct {
+	Model string          `json:"model"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// WithTenantDataModel Option registers a model holding tenant data under the supplied name.
+// Tenant exports, imports and erasure jobs walk the registered models, a model is exported
+// after the models it depends on and erased before them.
+func WithTenantDataModel(name string, model interface{}, dependsOn ...string) Option {
+	return func(s *Service) {
+		s.dataStore.tenantModels = append(s.dataStore.tenantModels, namedModel{name: name, model: model, dependsOn: dependsOn})
+	}
+}
+
+// tenantModelOrder sorts the registered tenant data models so that every model follows the models it depends on
+func (s *Service) tenantModelOrder() ([]namedModel, error) {
+	return orderModels("tenant data", s.dataStore.tenantModels)
+}
+
+// tenantDataContext reaches every row of the tenant wherever its data is stored
+func tenantDataContext(ctx context.Context, tenantID string) context.Context {
+	return withTenantRoute(AsSystem(ctx), tenantID)
+}
+
+// ExportTenantData streams every row of the tenant, optionally limited to a partition, to the writer as json lines.
+// The models registered with WithTenantDataModel are exported in dependency order reading them in batches ordered by id,
+// soft deleted rows are included so an import recreates the tenant as it is.
+// Every batch is read from the same snapshot so the export is consistent while the tenant keeps changing.
+func (s *Service) ExportTenantData(ctx context.Context, w io.Writer, tenantID string, partitionID string) error {
+
+	if tenantID == "" {
+		return errors.New("the tenant to export is required")
+	}
+
+	models, err := s.tenantModelOrder()
+	if err != nil {
+		return err
+	}
+
+	snapshot := &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	return s.dbTransaction(tenantDataContext(ctx, tenantID), true, func(ctx context.Context) error {
+		return s.exportTenantModels(ctx, json.NewEncoder(w), models, tenantID, partitionID)
+	}, snapshot)
+}
+
+// exportTenantModels encodes the rows of the tenant for each of the models in turn
+func (s *Service) exportTenantModels(ctx context.Context, encoder *json.Encoder, models []namedModel, tenantID string, partitionID string) error {
+
+	for _, model := range models {
+		modelType := reflect.Indirect(reflect.ValueOf(model.model)).Type()
+		lastID := ""
+
+		for {
+			db := s.DB(ctx, true)
+			if db == nil {
+				return errors.New("no database is setup to export from")
+			}
+
+			query := db.Unscoped().Where("tenant_id = ? AND id > ?", tenantID, lastID)
+			if partitionID != "" {
+				query = query.Where("partition_id = ?", partitionID)
+			}
+
+			rows := reflect.New(reflect.SliceOf(reflect.PtrTo(modelType)))
+			err := query.Order("id").Limit(defaultRepositoryBatchSize).Find(rows.Interface()).Error
+			if err != nil {
+				return err
+			}
+
+			batch := rows.Elem()
+			if batch.Len() == 0 {
+				break
+			}
+
+			for i := 0; i < batch.Len(); i++ {
+				row := batch.Index(i).Interface()
+
+				data, err := json.Marshal(row)
+				if err != nil {
+					return err
+				}
+
+				err = encoder.Encode(&tenantDataRecord{Model: model.name, Data: data})
+				if err != nil {
+					return err
+				}
+
+				if identified, ok := row.(BaseModelI); ok {
+					lastID = identified.GetID()
+				}
+			}
+
+			if batch.Len() < defaultRepositoryBatchSize || lastID == "" {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// ImportTenantData recreates the rows of a tenant export preserving their ids, versions and timestamps.
+// Rows already present are overwritten so an interrupted import can simply be run again.
+// Imported rows are restored rather than changed, they emit no lifecycle events but are dropped from the entity cache.
+func (s *Service) ImportTenantData(ctx context.Context, r io.Reader) error {
+
+	modelsByName := map[string]namedModel{}
+	for _, model := range s.dataStore.tenantModels {
+		modelsByName[model.name] = model
+	}
+
+	var batch reflect.Value
+	batchModel := ""
+	batchTenant := ""
+
+	flush := func() error {
+		if !batch.IsValid() || batch.Len() == 0 {
+			return nil
+		}
+
+		db := s.DB(tenantDataContext(ctx, batchTenant), false)
+		if db == nil {
+			return errors.New("no database is setup to import into")
+		}
+
+		rows := batch
+		batch = reflect.Value{}
+
+		result := withoutLifecycleEvents(db).Clauses(clause.OnConflict{UpdateAll: true}).Create(rows.Interface())
+		if result.Error != nil {
+			return result.Error
+		}
+
+		s.invalidateImportedRows(result, batchTenant, rows)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record tenantDataRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return fmt.Errorf("invalid record on line %d : %w", line, err)
+		}
+
+		model, ok := modelsByName[record.Model]
+		if !ok {
+			return fmt.Errorf("model %s on line %d is not registered", record.Model, line)
+		}
+
+		modelType := reflect.Indirect(reflect.ValueOf(model.model)).Type()
+		instance := reflect.New(modelType)
+		err = json.Unmarshal(record.Data, instance.Interface())
+		if err != nil {
+			return fmt.Errorf("invalid %s on line %d : %w", record.Model, line, err)
+		}
+
+		tenantID := ""
+		if tenantField := instance.Elem().FieldByName("TenantID"); tenantField.IsValid() && tenantField.Kind() == reflect.String {
+			tenantID = tenantField.String()
+		}
+
+		if record.Model != batchModel || tenantID != batchTenant || (batch.IsValid() && batch.Len() >= defaultRepositoryBatchSize) {
+			if err = flush(); err != nil {
+				return err
+			}
+			batchModel = record.Model
+			batchTenant = tenantID
+		}
+
+		if !batch.IsValid() {
+			batch = reflect.MakeSlice(reflect.SliceOf(instance.Type()), 0, defaultRepositoryBatchSize)
+		}
+		batch = reflect.Append(batch, instance)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+// TenantDataCommand runs the tenant data command in args, usually the command line arguments.
+// export TENANT [PARTITION] writes the tenant data to the standard output
+// and import [FILE] reads an export from the file or the standard input.
+func (s *Service) TenantDataCommand(ctx context.Context, args []string) error {
+
+	if len(args) == 0 {
+		return errors.New("a tenant data command, export or import, is required")
+	}
+
+	switch args[0] {
+	case "export":
+		if len(args) < 2 {
+			return errors.New("the tenant to export is required")
+		}
+
+		partitionID := ""
+		if len(args) > 2 {
+			partitionID = args[2]
+		}
+
+		writer := bufio.NewWriter(os.Stdout)
+		err := s.ExportTenantData(ctx, writer, args[1], partitionID)
+		if err != nil {
+			return err
+		}
+		return writer.Flush()
+
+	case "import":
+		if len(args) < 2 || args[1] == "-" {
+			return s.ImportTenantData(ctx, os.Stdin)
+		}
+
+		file, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return s.ImportTenantData(ctx, file)
+
+	default:
+		return fmt.Errorf("unknown tenant data command %s", args[0])
+	}
+}
+
+// invalidateImportedRows drops the cached copies of the imported rows once the transaction db takes part in commits
+func (s *Service) invalidateImportedRows(db *gorm.DB, tenantID string, rows reflect.Value) {
+	cache := s.dataStore.cache
+	if cache == nil || db.Statement.Schema == nil {
+		return
+	}
+
+	ids := make([]string, 0, rows.Len())
+	for i := 0; i < rows.Len(); i++ {
+		if identified, ok := rows.Index(i).Interface().(BaseModelI); ok {
+			ids = append(ids, identified.GetID())
+		}
+	}
+
+	keys := cache.entityKeys(tenantID, db.Statement.Schema.Table, ids...)
+	ctx := db.Statement.Context
+	afterCommit(db, func() {
+		cache.invalidate(ctx, keys...)
+	})
+}
@@ -0,0 +1,313 @@
+package frame
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+const (
+	// TenantIsolationShared keeps the tenant's data in the shared tables of the service database
+	TenantIsolationShared = "shared"
+	// TenantIsolationSchema keeps the tenant's data in a dedicated schema of the service database
+	TenantIsolationSchema = "schema"
+	// TenantIsolationDatabase keeps the tenant's data in a dedicated database
+	TenantIsolationDatabase = "database"
+
+	tenantRoutingDefaultTTL = 5 * time.Minute
+)
+
+const ctxKeyTenantRoute = contextKey("tenantRouteKey")
+
+// TenantRoute records where the data of a tenant is physically stored.
+// Tenants without a route use the shared tables of the service database.
+type TenantRoute struct {
+	TenantID           string `gorm:"type:varchar(50);primary_key"`
+	Isolation          string `gorm:"type:varchar(20)"`
+	SchemaName         string `gorm:"type:varchar(63)"`
+	DatabaseURL        string `gorm:"type:text"`
+	ReplicaDatabaseURL string `gorm:"type:text"`
+	CreatedAt          time.Time
+	ModifiedAt         time.Time
+}
+
+// Schema returns the name of the schema holding the tenant's data, by default tenant_ followed by the tenant id
+func (route *TenantRoute) Schema() string {
+	if route.SchemaName != "" {
+		return route.SchemaName
+	}
+	return "tenant_" + route.TenantID
+}
+
+type cachedTenantRoute struct {
+	route    *TenantRoute
+	loadedAt time.Time
+}
+
+type tenantPool struct {
+	db       *gorm.DB
+	err      error
+	openedAt time.Time
+}
+
+type tenantRouter struct {
+	service   *Service
+	ttl       time.Duration
+	routes    sync.Map
+	pools     sync.Map
+	poolMutex sync.Mutex
+}
+
+// WithTenantRouting Option that enables physical isolation of tenants.
+// The TenantRoute table in the service database decides whether DB resolves a tenant to the shared tables,
+// to a dedicated schema through the search_path or to a dedicated connection pool.
+// The tenant is taken from the authentication claims in the context, routes are cached for the ttl which is 5 minutes by default.
+func WithTenantRouting(ttl time.Duration) Option {
+	return func(s *Service) {
+		if ttl <= 0 {
+			ttl = tenantRoutingDefaultTTL
+		}
+
+		s.dataStore.routing = &tenantRouter{
+			service: s,
+			ttl:     ttl,
+		}
+	}
+}
+
+// withTenantRoute makes DB resolve the storage of the supplied tenant, an empty tenant id resolves the shared storage
+func withTenantRoute(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, ctxKeyTenantRoute, tenantID)
+}
+
+// routedTenant returns the tenant whose storage should be used for the context
+func routedTenant(ctx context.Context) string {
+	if tenantID, ok := ctx.Value(ctxKeyTenantRoute).(string); ok {
+		return tenantID
+	}
+
+	authClaim := ClaimsFromContext(ctx)
+	if authClaim == nil {
+		return ""
+	}
+	return authClaim.TenantID
+}
+
+// SaveTenantRoute stores where the data of a tenant lives and drops any cached route for it.
+// Migrations for a newly isolated tenant are applied the next time MigrateDatastore runs.
+func (s *Service) SaveTenantRoute(ctx context.Context, route *TenantRoute) error {
+	if s.dataStore.routing == nil {
+		return errors.New("tenant routing is not enabled")
+	}
+
+	if route.Isolation == "" {
+		route.Isolation = TenantIsolationShared
+	}
+
+	err := s.DB(withTenantRoute(AsSystem(ctx), ""), false).Save(route).Error
+	if err != nil {
+		return err
+	}
+
+	s.dataStore.routing.routes.Delete(route.TenantID)
+	return nil
+}
+
+// InvalidateTenantRoute drops the cached route of a tenant so that it is reloaded on next use
+func (s *Service) InvalidateTenantRoute(tenantID string) {
+	if s.dataStore.routing != nil {
+		s.dataStore.routing.routes.Delete(tenantID)
+	}
+}
+
+// route returns the route of the tenant in the context or nil if it uses the shared storage.
+// When the route can not be loaded the expired route cached for the tenant keeps being used,
+// a tenant without one gets an error so that its data never ends up in the shared storage.
+func (tr *tenantRouter) route(ctx context.Context) (*TenantRoute, error) {
+	tenantID := routedTenant(ctx)
+	if tenantID == "" {
+		return nil, nil
+	}
+
+	var stale *cachedTenantRoute
+	if cached, ok := tr.routes.Load(tenantID); ok {
+		stale = cached.(*cachedTenantRoute)
+		if time.Since(stale.loadedAt) < tr.ttl {
+			return stale.route, nil
+		}
+	}
+
+	routes, err := tr.loadRoute(ctx, tenantID)
+	if err != nil {
+		if stale != nil {
+			tr.service.L().WithError(err).WithField("tenant", tenantID).Warn("could not reload tenant route, using the cached one")
+			return stale.route, nil
+		}
+		tr.service.L().WithError(err).WithField("tenant", tenantID).Warn("could not load tenant route")
+		return nil, fmt.Errorf("could not resolve the storage of tenant %s : %w", tenantID, err)
+	}
+
+	var route *TenantRoute
+	if len(routes) > 0 && routes[0].Isolation != "" && routes[0].Isolation != TenantIsolationShared {
+		route = &routes[0]
+	}
+
+	tr.routes.Store(tenantID, &cachedTenantRoute{route: route, loadedAt: time.Now()})
+	return route, nil
+}
+
+// loadRoute reads the route of the tenant from the service database
+func (tr *tenantRouter) loadRoute(ctx context.Context, tenantID string) ([]TenantRoute, error) {
+	// Routes are read on the connection pinned for the service database when there is one
+	lookupCtx := withTenantRoute(AsSystem(ctx), "")
+	db := tr.service.dbConnection(lookupCtx, true)
+	if db == nil {
+		return nil, errors.New("no database is setup to load tenant routes from")
+	}
+
+	var routes []TenantRoute
+	err := db.WithContext(lookupCtx).Where("tenant_id = ?", tenantID).Limit(1).Find(&routes).Error
+	return routes, err
+}
+
+// schema returns the schema of the tenant in the context when it is schema isolated
+func (tr *tenantRouter) schema(ctx context.Context) (string, error) {
+	route, err := tr.route(ctx)
+	if err != nil || route == nil || route.Isolation != TenantIsolationSchema {
+		return "", err
+	}
+	return route.Schema(), nil
+}
+
+// connection returns the connection pool of the tenant in the context when it is database isolated
+func (tr *tenantRouter) connection(ctx context.Context, readOnly bool) *gorm.DB {
+	route, err := tr.route(ctx)
+	if err != nil {
+		return tr.failedConnection(readOnly, err)
+	}
+	if route == nil || route.Isolation != TenantIsolationDatabase || route.DatabaseURL == "" {
+		return nil
+	}
+
+	databaseURL := route.DatabaseURL
+	if readOnly && route.ReplicaDatabaseURL != "" {
+		databaseURL = route.ReplicaDatabaseURL
+	}
+
+	db, err := tr.pool(databaseURL)
+	if err != nil {
+		return tr.failedConnection(readOnly, fmt.Errorf("could not open the database of tenant %s : %w", route.TenantID, err))
+	}
+	return db
+}
+
+// failedConnection returns a connection whose statements all fail with err,
+// so that the data of an isolated tenant never ends up in the shared storage
+func (tr *tenantRouter) failedConnection(readOnly bool, err error) *gorm.DB {
+	db := tr.service.defaultConnection(readOnly)
+	if db == nil {
+		return nil
+	}
+
+	db = db.Session(&gorm.Session{NewDB: true})
+	_ = db.AddError(err)
+	return db
+}
+
+// pool returns the connection pool for a tenant database opening it on first use.
+// A database that could not be opened is only tried again once the ttl of the routes has passed.
+func (tr *tenantRouter) pool(databaseURL string) (*gorm.DB, error) {
+	if pool, ok := tr.cachedPool(databaseURL); ok {
+		return pool.db, pool.err
+	}
+
+	tr.poolMutex.Lock()
+	defer tr.poolMutex.Unlock()
+
+	if pool, ok := tr.cachedPool(databaseURL); ok {
+		return pool.db, pool.err
+	}
+
+	gormDB, db, err := tr.service.openDatastore(databaseURL)
+	if err != nil {
+		tr.service.L().WithError(err).Warn("could not open tenant database")
+		tr.pools.Store(databaseURL, &tenantPool{err: err, openedAt: time.Now()})
+		return nil, err
+	}
+
+	tr.service.AddCleanupMethod(func(ctx context.Context) {
+		_ = db.Close()
+	})
+
+	tr.pools.Store(databaseURL, &tenantPool{db: gormDB, openedAt: time.Now()})
+	return gormDB, nil
+}
+
+// cachedPool returns the pool opened for the database unless opening it failed longer than the ttl ago
+func (tr *tenantRouter) cachedPool(databaseURL string) (*tenantPool, bool) {
+	entry, ok := tr.pools.Load(databaseURL)
+	if !ok {
+		return nil, false
+	}
+
+	pool := entry.(*tenantPool)
+	if pool.err != nil && time.Since(pool.openedAt) >= tr.ttl {
+		return nil, false
+	}
+	return pool, true
+}
+
+// isolatedRoutes lists the tenants that have a dedicated schema or database
+func (tr *tenantRouter) isolatedRoutes(ctx context.Context) ([]TenantRoute, error) {
+	var routes []TenantRoute
+	err := tr.service.DB(withTenantRoute(AsSystem(ctx), ""), true).
+		Where("isolation IN ?", []string{TenantIsolationSchema, TenantIsolationDatabase}).
+		Find(&routes).Error
+	return routes, err
+}
+
+// eachTenantDatastore runs fn against the schema or database of every isolated tenant.
+// The work on a tenant runs on one connection holding its search_path, without wrapping it in a transaction,
+// so each migration runs in its own transaction or outside of one as it requires.
+func (tr *tenantRouter) eachTenantDatastore(ctx context.Context, fn func(ctx context.Context, route TenantRoute) error) error {
+
+	routes, err := tr.isolatedRoutes(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, route := range routes {
+		tenantCtx := withTenantRoute(AsSystem(ctx), route.TenantID)
+
+		err = tr.service.withPinnedConnection(tenantCtx, func(ctx context.Context) error {
+			return fn(ctx, route)
+		})
+
+		if err != nil {
+			tr.service.L().WithError(err).WithField("tenant", route.TenantID).WithField("isolation", route.Isolation).
+				Error("eachTenantDatastore -- could not process tenant datastore")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateTenantDatastores applies the migrations to the schema or database of every isolated tenant
+func (tr *tenantRouter) migrateTenantDatastores(ctx context.Context, migrationsDirPath string, migrations ...interface{}) error {
+
+	return tr.eachTenantDatastore(ctx, func(tenantCtx context.Context, route TenantRoute) error {
+		if route.Isolation == TenantIsolationSchema {
+			err := tr.service.DB(withTenantRoute(AsSystem(ctx), ""), false).
+				Exec("CREATE SCHEMA IF NOT EXISTS " + quoteSchema(route.Schema())).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return tr.service.migrateDatastore(tenantCtx, migrationsDirPath, migrations...)
+	})
+}
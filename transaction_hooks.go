@@ -0,0 +1,109 @@
+package frame
+
+import (
+	"context"
+	"database/sql"
+	"gorm.io/gorm"
+	"strings"
+	"sync"
+)
+
+// hookedConnPool is the connection pool of a datastore, transactions begun from it run hooks once they commit
+type hookedConnPool struct {
+	*sql.DB
+}
+
+func (p *hookedConnPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	tx, err := p.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &hookedTx{Tx: tx, db: p.DB}, nil
+}
+
+func (p *hookedConnPool) GetDBConn() (*sql.DB, error) {
+	return p.DB, nil
+}
+
+// hookedTx holds back the hooks registered by its statements until it commits, they are dropped on rollback
+type hookedTx struct {
+	*sql.Tx
+	db *sql.DB
+	// pinned is the connection the transaction was begun on when it was pinned
+	pinned *pinnedConnPool
+
+	mutex sync.Mutex
+	hooks []func()
+	// savePoints holds the number of hooks registered before each savepoint of a nested transaction
+	savePoints map[string]int
+}
+
+// ExecContext keeps track of the savepoints of nested transactions, so that hooks registered
+// after a savepoint are dropped when the transaction is rolled back to it
+func (tx *hookedTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	result, err := tx.Tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return result, err
+	}
+
+	if name, ok := strings.CutPrefix(query, "SAVEPOINT "); ok {
+		tx.mutex.Lock()
+		if tx.savePoints == nil {
+			tx.savePoints = map[string]int{}
+		}
+		tx.savePoints[name] = len(tx.hooks)
+		tx.mutex.Unlock()
+	} else if name, ok := strings.CutPrefix(query, "ROLLBACK TO SAVEPOINT "); ok {
+		tx.mutex.Lock()
+		if count, exists := tx.savePoints[name]; exists && count < len(tx.hooks) {
+			tx.hooks = tx.hooks[:count]
+		}
+		tx.mutex.Unlock()
+	}
+	return result, nil
+}
+
+func (tx *hookedTx) GetDBConn() (*sql.DB, error) {
+	return tx.db, nil
+}
+
+func (tx *hookedTx) takeHooks() []func() {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	hooks := tx.hooks
+	tx.hooks = nil
+	return hooks
+}
+
+func (tx *hookedTx) Commit() error {
+	hooks := tx.takeHooks()
+
+	err := tx.Tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		hook()
+	}
+	return nil
+}
+
+func (tx *hookedTx) Rollback() error {
+	tx.takeHooks()
+	return tx.Tx.Rollback()
+}
+
+// afterCommit runs fn once the outermost transaction db takes part in commits, right away outside a transaction.
+// Hooks of a nested transaction that is rolled back to its savepoint are dropped with its changes.
+func afterCommit(db *gorm.DB, fn func()) {
+	tx, ok := db.Statement.ConnPool.(*hookedTx)
+	if !ok {
+		fn()
+		return
+	}
+
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	tx.hooks = append(tx.hooks, fn)
+}
@@ -3,6 +3,7 @@ package frame
 import (
 	"context"
 	"errors"
+	"github.com/alitto/pond"
 	"github.com/rs/xid"
 	"runtime/debug"
 )
@@ -123,8 +124,12 @@ func WithPoolCapacity(capacity int) Option {
 //
 //	err, ok := <- errChan
 func (s *Service) SubmitJob(ctx context.Context, job Job) error {
+	return s.submitJobToPool(ctx, s.pool, job)
+}
+
+// submitJobToPool runs the job on the pool, retrying it there and piping its error as SubmitJob describes
+func (s *Service) submitJobToPool(ctx context.Context, p *pond.WorkerPool, job Job) error {
 
-	p := s.pool
 	if p.Stopped() {
 		return errors.New("pool is closed")
 	}
@@ -153,7 +158,7 @@ func (s *Service) SubmitJob(ctx context.Context, job Job) error {
 					retries := job.DecreaseRetries()
 
 					retryJob := s.NewJobWithRetryAndErrorChan(job.F(), retries, job.ErrChan())
-					err1 := s.SubmitJob(ctx, retryJob)
+					err1 := s.submitJobToPool(ctx, p, retryJob)
 					if err1 != nil {
 						logger.
 							WithField("stacktrace", string(debug.Stack())).